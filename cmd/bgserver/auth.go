@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authenticator checks requests against a shared secret. Clients either send
+// the secret itself or a signed token minted from it ("<expiry>.<signature>",
+// see signToken) as "Authorization: Bearer ...", or as ?token= for
+// EventSource clients that cannot set headers. A nil authenticator or empty
+// secret disables authentication.
+type authenticator struct {
+	secret []byte
+}
+
+var errUnauthorized = errors.New("missing or invalid credentials")
+
+func (a *authenticator) Check(r *http.Request) error {
+	if a == nil || len(a.secret) == 0 {
+		return nil
+	}
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if tok == "" {
+		tok = r.URL.Query().Get("token")
+	}
+	if tok == "" {
+		return errUnauthorized
+	}
+	if subtle.ConstantTimeCompare([]byte(tok), a.secret) == 1 {
+		return nil
+	}
+	return a.verify(tok, time.Now())
+}
+
+// signToken mints a token that is valid until now+ttl.
+func (a *authenticator) signToken(now time.Time, ttl time.Duration) string {
+	exp := strconv.FormatInt(now.Add(ttl).Unix(), 10)
+	return exp + "." + a.sign(exp)
+}
+
+func (a *authenticator) verify(tok string, now time.Time) error {
+	exp, sig, ok := strings.Cut(tok, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(a.sign(exp))) {
+		return errUnauthorized
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() > unix {
+		return errors.New("token expired")
+	}
+	return nil
+}
+
+func (a *authenticator) sign(msg string) string {
+	m := hmac.New(sha256.New, a.secret)
+	m.Write([]byte(msg))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// rateLimiter is a per-client token bucket: each client may burst up to
+// burst requests and then earns rate tokens per second. A nil limiter or a
+// non-positive rate allows everything.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    perMinute / 60,
+		burst:   math.Max(1, float64(burst)),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token for key, or reports how long until one is available.
+func (l *rateLimiter) Allow(key string) (time.Duration, bool) {
+	if l == nil || l.rate <= 0 {
+		return 0, true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// sweep forgets clients whose buckets have refilled completely. Callers hold l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// clientIP returns the address used to key rate limits.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is the server's resolved configuration. Values are layered as
+// defaults < config file < environment < command-line flags.
+type config struct {
+	Addr    string `json:"addr"`
+	TLSCert string `json:"tlsCert"`
+	TLSKey  string `json:"tlsKey"`
+
+	// Image provider. Only "replicate" is implemented.
+	Provider        string   `json:"provider"`
+	Model           string   `json:"model"`
+	ProviderToken   string   `json:"providerToken"`
+	ProviderWait    duration `json:"providerWait"`    // synchronous wait on create, 0 disables
+	ProviderTimeout duration `json:"providerTimeout"` // per HTTP call to the provider
+	JobTimeout      duration `json:"jobTimeout"`      // whole generation, including polling and processing
+	ShutdownGrace   duration `json:"shutdownGrace"`
+	Workers         int      `json:"workers"`
+	QueueSize       int      `json:"queueSize"`
+
+	// Request limits and defaults.
+	DefaultWidth   int   `json:"defaultWidth"`
+	DefaultHeight  int   `json:"defaultHeight"`
+	MinSize        int   `json:"minSize"`
+	MaxSize        int   `json:"maxSize"`
+	MaxBodyBytes   int64 `json:"maxBodyBytes"`
+	MaxPromptChars int   `json:"maxPromptChars"`
+
+	ImageDir    string `json:"imageDir"`
+	PromptsFile string `json:"promptsFile"`
+
+	AuthSecret     string   `json:"authSecret"`
+	AllowedOrigins []string `json:"allowedOrigins"`
+	RatePerMinute  float64  `json:"ratePerMinute"`
+	RateBurst      int      `json:"rateBurst"`
+	TrustProxy     bool     `json:"trustProxy"`
+
+	PoolSize          int      `json:"poolSize"`
+	PoolStyles        []string `json:"poolStyles"`
+	PoolWidth         int      `json:"poolWidth"`
+	PoolHeight        int      `json:"poolHeight"`
+	PoolBudgetPerHour int      `json:"poolBudgetPerHour"`
+
+	LogFormat string `json:"logFormat"`
+	LogLevel  string `json:"logLevel"`
+}
+
+func defaultConfig() config {
+	return config{
+		Addr:              ":8787",
+		Provider:          "replicate",
+		Model:             "black-forest-labs/flux-1.1-pro",
+		ProviderTimeout:   duration(90 * time.Second),
+		JobTimeout:        duration(2 * time.Minute),
+		ShutdownGrace:     duration(30 * time.Second),
+		Workers:           2,
+		QueueSize:         16,
+		DefaultWidth:      1024,
+		DefaultHeight:     768,
+		MinSize:           64,
+		MaxSize:           4096,
+		MaxBodyBytes:      16 << 10,
+		MaxPromptChars:    1000,
+		ImageDir:          defaultImageDir(),
+		AllowedOrigins:    []string{"*"},
+		RatePerMinute:     6,
+		RateBurst:         3,
+		PoolStyles:        []string{"limbo_forest", "limbo_industrial"},
+		PoolWidth:         1600,
+		PoolHeight:        900,
+		PoolBudgetPerHour: 10,
+		LogFormat:         "text",
+		LogLevel:          "info",
+	}
+}
+
+// option binds one config field to its flag and environment variable.
+// Secrets have no flag so they never show up in process listings.
+type option struct {
+	flag, env string
+	usage     string
+	set       func(string) error
+	isBool    bool
+}
+
+func (c *config) options() []option {
+	return []option{
+		{flag: "addr", env: "BG_ADDR", usage: "listen address", set: stringVar(&c.Addr)},
+		{flag: "tls-cert", env: "BG_TLS_CERT", usage: "TLS certificate file", set: stringVar(&c.TLSCert)},
+		{flag: "tls-key", env: "BG_TLS_KEY", usage: "TLS key file", set: stringVar(&c.TLSKey)},
+		{flag: "provider", env: "BG_PROVIDER", usage: "image provider", set: stringVar(&c.Provider)},
+		{flag: "model", env: "BG_MODEL", usage: "provider model", set: stringVar(&c.Model)},
+		{env: "REPLICATE_API_TOKEN", set: stringVar(&c.ProviderToken)},
+		{flag: "provider-wait", env: "REPLICATE_WAIT_SECONDS", usage: "synchronous wait on create (0 to poll only)", set: durationVar(&c.ProviderWait)},
+		{flag: "provider-timeout", env: "BG_PROVIDER_TIMEOUT", usage: "timeout of one provider HTTP call", set: durationVar(&c.ProviderTimeout)},
+		{flag: "job-timeout", env: "BG_JOB_TIMEOUT", usage: "timeout of a whole generation", set: durationVar(&c.JobTimeout)},
+		{flag: "shutdown-grace", env: "BG_SHUTDOWN_GRACE_SECONDS", usage: "time to finish in-flight jobs on shutdown", set: durationVar(&c.ShutdownGrace)},
+		{flag: "workers", env: "BG_WORKERS", usage: "concurrent generations", set: intVar(&c.Workers)},
+		{flag: "queue-size", env: "BG_QUEUE_SIZE", usage: "jobs that may wait for a worker", set: intVar(&c.QueueSize)},
+		{flag: "default-width", env: "BG_DEFAULT_WIDTH", usage: "width when a request omits it", set: intVar(&c.DefaultWidth)},
+		{flag: "default-height", env: "BG_DEFAULT_HEIGHT", usage: "height when a request omits it", set: intVar(&c.DefaultHeight)},
+		{flag: "min-size", env: "BG_MIN_SIZE", usage: "smallest accepted width/height", set: intVar(&c.MinSize)},
+		{flag: "max-size", env: "BG_MAX_SIZE", usage: "largest accepted width/height", set: intVar(&c.MaxSize)},
+		{flag: "max-body-bytes", env: "BG_MAX_BODY_BYTES", usage: "request body limit", set: int64Var(&c.MaxBodyBytes)},
+		{flag: "max-prompt-chars", env: "BG_MAX_PROMPT_CHARS", usage: "prompt length limit", set: intVar(&c.MaxPromptChars)},
+		{flag: "image-dir", env: "BG_IMAGE_DIR", usage: "image cache directory", set: stringVar(&c.ImageDir)},
+		{flag: "prompts-file", env: "BG_PROMPTS_FILE", usage: "JSON prompt templates layered over the defaults", set: stringVar(&c.PromptsFile)},
+		{env: "BG_AUTH_SECRET", set: stringVar(&c.AuthSecret)},
+		{flag: "allowed-origins", env: "BG_ALLOWED_ORIGINS", usage: "comma-separated CORS origins, * for any", set: listVar(&c.AllowedOrigins)},
+		{flag: "rate-per-minute", env: "BG_RATE_PER_MINUTE", usage: "generations per client IP per minute, 0 for no limit", set: floatVar(&c.RatePerMinute)},
+		{flag: "rate-burst", env: "BG_RATE_BURST", usage: "rate limiter burst", set: intVar(&c.RateBurst)},
+		{flag: "trust-proxy", env: "BG_TRUST_PROXY", usage: "trust X-Forwarded-For and X-Forwarded-Proto", set: boolVar(&c.TrustProxy), isBool: true},
+		{flag: "pool-size", env: "BG_POOL_SIZE", usage: "ready images kept per pool style (0 disables)", set: intVar(&c.PoolSize)},
+		{flag: "pool-styles", env: "BG_POOL_STYLES", usage: "comma-separated pool styles", set: listVar(&c.PoolStyles)},
+		{flag: "pool-width", env: "BG_POOL_WIDTH", usage: "pool image width", set: intVar(&c.PoolWidth)},
+		{flag: "pool-height", env: "BG_POOL_HEIGHT", usage: "pool image height", set: intVar(&c.PoolHeight)},
+		{flag: "pool-budget", env: "BG_POOL_BUDGET_PER_HOUR", usage: "pool generations per hour", set: intVar(&c.PoolBudgetPerHour)},
+		{flag: "log-format", env: "BG_LOG_FORMAT", usage: "text or json", set: stringVar(&c.LogFormat)},
+		{flag: "log-level", env: "BG_LOG_LEVEL", usage: "debug, info, warn or error", set: stringVar(&c.LogLevel)},
+	}
+}
+
+// loadConfig resolves the configuration from args and the environment. It
+// returns the remaining positional arguments and whether --print-config was
+// given.
+func loadConfig(args []string) (cfg config, rest []string, printOnly bool, err error) {
+	cfg = defaultConfig()
+	opts := cfg.options()
+
+	fs := flag.NewFlagSet("bgserver", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("BG_CONFIG"), "JSON config file (env BG_CONFIG)")
+	fs.BoolVar(&printOnly, "print-config", false, "print the resolved configuration with secrets redacted and exit")
+	// Flags are recorded while parsing and applied last, after the file
+	// (whose path is itself a flag) and the environment.
+	var pending []func() error
+	for _, o := range opts {
+		if o.flag != "" {
+			fs.Var(&lateFlag{opt: o, pending: &pending}, o.flag, fmt.Sprintf("%s (env %s)", o.usage, o.env))
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, false, err
+	}
+
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return cfg, nil, false, err
+		}
+	}
+	for _, o := range opts {
+		if v, ok := os.LookupEnv(o.env); ok && v != "" {
+			if err := o.set(v); err != nil {
+				return cfg, nil, false, fmt.Errorf("%s: %w", o.env, err)
+			}
+		}
+	}
+	for _, apply := range pending {
+		if err := apply(); err != nil {
+			return cfg, nil, false, err
+		}
+	}
+	return cfg, fs.Args(), printOnly, cfg.validate()
+}
+
+func (c *config) loadFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Provider == "replicate", "provider %q is not supported", c.Provider)
+	check(c.Model != "", "model must be set")
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tlsCert and tlsKey must be set together")
+	check(c.ProviderWait >= 0 && c.ProviderWait <= duration(60*time.Second), "providerWait must be 0-60s")
+	check(c.ProviderTimeout > 0 && c.JobTimeout > 0 && c.ShutdownGrace >= 0, "timeouts must be positive")
+	check(c.Workers >= 1 && c.QueueSize >= 1, "workers and queueSize must be at least 1")
+	check(c.MinSize >= 1 && c.MinSize <= c.MaxSize, "minSize must be between 1 and maxSize")
+	check(c.DefaultWidth >= c.MinSize && c.DefaultWidth <= c.MaxSize &&
+		c.DefaultHeight >= c.MinSize && c.DefaultHeight <= c.MaxSize,
+		"defaultWidth and defaultHeight must be within minSize and maxSize")
+	check(c.MaxBodyBytes > 0 && c.MaxPromptChars > 0, "maxBodyBytes and maxPromptChars must be positive")
+	check(c.ImageDir != "", "imageDir must be set")
+	check(c.RatePerMinute >= 0 && c.RateBurst >= 1, "ratePerMinute must not be negative and rateBurst must be at least 1")
+	check(c.PoolSize >= 0 && c.PoolBudgetPerHour >= 0, "poolSize and poolBudgetPerHour must not be negative")
+	check(c.LogFormat == "text" || c.LogFormat == "json", "logFormat must be text or json")
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.LogLevel)) == nil, "logLevel %q is not a level", c.LogLevel)
+	return errors.Join(errs...)
+}
+
+// print writes the configuration as JSON with secrets redacted.
+func (c config) print(w io.Writer) error {
+	for _, s := range []*string{&c.ProviderToken, &c.AuthSecret} {
+		if *s != "" {
+			*s = "<redacted>"
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(c)
+}
+
+// lateFlag records a flag's value for loadConfig to apply after the
+// environment.
+type lateFlag struct {
+	opt     option
+	pending *[]func() error
+}
+
+func (f *lateFlag) String() string   { return "" }
+func (f *lateFlag) IsBoolFlag() bool { return f.opt.isBool }
+
+func (f *lateFlag) Set(v string) error {
+	o := f.opt
+	*f.pending = append(*f.pending, func() error {
+		if err := o.set(v); err != nil {
+			return fmt.Errorf("-%s: %w", o.flag, err)
+		}
+		return nil
+	})
+	return nil
+}
+
+// duration is a time.Duration that reads "90s"-style strings and bare
+// numbers of seconds, and is written as a string.
+type duration time.Duration
+
+func parseDuration(s string) (duration, error) {
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return duration(n * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	return duration(d), err
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		s = string(b)
+	}
+	v, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+func stringVar(p *string) func(string) error {
+	return func(v string) error { *p = v; return nil }
+}
+
+func intVar(p *int) func(string) error {
+	return func(v string) (err error) { *p, err = strconv.Atoi(v); return err }
+}
+
+func int64Var(p *int64) func(string) error {
+	return func(v string) (err error) { *p, err = strconv.ParseInt(v, 10, 64); return err }
+}
+
+func floatVar(p *float64) func(string) error {
+	return func(v string) (err error) { *p, err = strconv.ParseFloat(v, 64); return err }
+}
+
+func boolVar(p *bool) func(string) error {
+	return func(v string) (err error) { *p, err = strconv.ParseBool(v); return err }
+}
+
+func durationVar(p *duration) func(string) error {
+	return func(v string) (err error) { *p, err = parseDuration(v); return err }
+}
+
+func listVar(p *[]string) func(string) error {
+	return func(v string) error { *p = splitList(v); return nil }
+}
+
+// splitList parses a comma-separated list.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
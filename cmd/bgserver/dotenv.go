@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// loadEnvFiles applies dotenv files in order. Variables already present in
+// the environment (including ones set by an earlier file) are not
+// overridden, so the real environment beats .env.local, which beats .env.
+func loadEnvFiles(paths ...string) error {
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			continue
+		}
+		vars, err := parseDotenv(f)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		for _, kv := range vars {
+			if _, set := os.LookupEnv(kv[0]); !set {
+				_ = os.Setenv(kv[0], kv[1])
+			}
+		}
+	}
+	return nil
+}
+
+// parseDotenv reads KEY=VALUE pairs in file order. It understands blank
+// lines, # comments, an optional "export " prefix, unquoted values with
+// trailing " # comments", 'single-quoted' literal values and
+// "double-quoted" values with \n, \t, \", \\ escapes that may span lines.
+func parseDotenv(r io.Reader) ([][2]string, error) {
+	var out [][2]string
+	sc := bufio.NewScanner(r)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, rest, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t\"'") {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNo)
+		}
+		rest = strings.TrimLeft(rest, " \t")
+
+		var val string
+		switch {
+		case strings.HasPrefix(rest, "'"):
+			end := strings.IndexByte(rest[1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated single quote", lineNo)
+			}
+			val = rest[1 : 1+end]
+		case strings.HasPrefix(rest, `"`):
+			// the value may continue over following lines until the closing quote
+			buf := rest[1:]
+			for {
+				v, closed := unescapeDoubleQuoted(buf)
+				if closed {
+					val = v
+					break
+				}
+				if !sc.Scan() {
+					return nil, fmt.Errorf("line %d: unterminated double quote", lineNo)
+				}
+				lineNo++
+				buf += "\n" + sc.Text()
+			}
+		default:
+			if i := strings.Index(rest, " #"); i >= 0 {
+				rest = rest[:i]
+			}
+			val = strings.TrimSpace(rest)
+		}
+		out = append(out, [2]string{key, val})
+	}
+	return out, sc.Err()
+}
+
+// unescapeDoubleQuoted decodes s up to its closing double quote, reporting
+// whether the quote was found.
+func unescapeDoubleQuoted(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return b.String(), true
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", false
+}
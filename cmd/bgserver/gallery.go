@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/stoneresearch/dimalimbo/internal/bgservice"
+)
+
+// background converts a pool entry to its API shape.
+func (s *server) background(r *http.Request, e poolEntry) bgservice.Background {
+	b := bgservice.Background{
+		Hash:      e.Hash,
+		Style:     e.Style,
+		Prompt:    e.Prompt,
+		Seed:      e.Seed,
+		CreatedAt: e.CreatedAt,
+		Served:    e.Served,
+		Pinned:    e.Pinned,
+		Banned:    e.Banned,
+	}
+	if !e.Banned {
+		b.URL = s.publicURL(r, "/images/"+e.Hash)
+	}
+	return b
+}
+
+func (s *server) handleList(w http.ResponseWriter, r *http.Request) {
+	entries := s.pool.List(r.URL.Query().Get("style"))
+	items := make([]bgservice.Background, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, s.background(r, e))
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// handleMark pins, unpins or bans a background: {"pinned": true|false} or {"banned": true}.
+func (s *server) handleMark(w http.ResponseWriter, r *http.Request) {
+	var body bgservice.Mark
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<10)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	e, ok := s.pool.Mark(r.PathValue("hash"), body.Pinned, body.Banned)
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown background")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.background(r, e))
+}
+
+// handleGallery serves the team's browse/pin/ban page. It is opened as
+// /gallery?token=... and calls the API with that same token.
+func (s *server) handleGallery(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(galleryHTML))
+}
+
+const galleryHTML = `<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>DIMBO backgrounds</title>
+<style>
+  body { background: #0a0a0c; color: #bbb; font: 14px system-ui, sans-serif; margin: 2rem; }
+  h1 { font-weight: 300; letter-spacing: .2em; }
+  select, button { background: #1a1a1e; color: #ccc; border: 1px solid #333; padding: .3rem .6rem; }
+  .grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(320px, 1fr)); gap: 1rem; }
+  .card { background: #121215; border: 1px solid #222; padding: .5rem; }
+  .card img { width: 100%; display: block; }
+  .card.banned { opacity: .35; }
+  .card.pinned { border-color: #8a7; }
+  .meta { font-size: 12px; color: #777; margin: .4rem 0; overflow-wrap: anywhere; }
+</style>
+</head>
+<body>
+<h1>BACKGROUNDS</h1>
+<p>Style: <select id="style"><option value="">all</option></select></p>
+<div class="grid" id="grid"></div>
+<script>
+const token = new URLSearchParams(location.search).get('token') || '';
+const headers = token ? { 'Authorization': 'Bearer ' + token } : {};
+const grid = document.getElementById('grid');
+const styleSel = document.getElementById('style');
+
+async function load() {
+  const q = styleSel.value ? '?style=' + encodeURIComponent(styleSel.value) : '';
+  const res = await fetch('/api/backgrounds' + q, { headers });
+  if (!res.ok) { grid.textContent = 'Error ' + res.status; return; }
+  const items = await res.json();
+  const styles = new Set([...styleSel.options].map(o => o.value));
+  grid.replaceChildren();
+  for (const it of items) {
+    if (!styles.has(it.style)) { styleSel.add(new Option(it.style, it.style)); styles.add(it.style); }
+    const card = document.createElement('div');
+    card.className = 'card' + (it.pinned ? ' pinned' : '') + (it.banned ? ' banned' : '');
+    if (it.url) { const img = document.createElement('img'); img.src = it.url; img.loading = 'lazy'; card.append(img); }
+    const meta = document.createElement('div');
+    meta.className = 'meta';
+    meta.textContent = it.style + ' · served ' + it.served + '× · ' + new Date(it.createdAt).toLocaleString() + ' — ' + it.prompt;
+    card.append(meta);
+    if (!it.banned) {
+      card.append(button(it.pinned ? 'Unpin' : 'Pin', { pinned: !it.pinned }, it.hash), ' ', button('Ban', { banned: true }, it.hash));
+    }
+    grid.append(card);
+  }
+}
+
+function button(label, body, hash) {
+  const b = document.createElement('button');
+  b.textContent = label;
+  b.onclick = async () => {
+    await fetch('/api/backgrounds/' + hash, { method: 'PATCH', headers: { ...headers, 'Content-Type': 'application/json' }, body: JSON.stringify(body) });
+    load();
+  };
+  return b;
+}
+
+styleSel.onchange = load;
+load();
+</script>
+</body>
+</html>
+`
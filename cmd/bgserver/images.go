@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// maxImageBytes caps how much we download from the provider for one image.
+const maxImageBytes = 32 << 20
+
+var imageTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+}
+
+// processOptions controls server-side post-processing of a generated image.
+type processOptions struct {
+	Width, Height int     // output size; the source is scaled to cover and centre-cropped
+	Format        string  // jpeg or png
+	Quality       int     // JPEG quality 1-100
+	Desaturate    float64 // 0 keeps colour, 1 is fully greyscale
+	Darken        float64 // 0..1 brightness reduction
+	Vignette      float64 // 0..1 edge darkening
+}
+
+// limboLook is the preset behind {"look": "limbo"}: monochrome, dim and
+// heavily vignetted to sit under the game's silhouettes.
+var limboLook = processOptions{Desaturate: 1, Darken: 0.35, Vignette: 0.7}
+
+func (o processOptions) filtered() bool {
+	return o.Desaturate > 0 || o.Darken > 0 || o.Vignette > 0
+}
+
+// imageStore downloads generated images, post-processes them and keeps the
+// results on disk under their content hash so they can be served from
+// /images/{hash} instead of hotlinking the provider.
+type imageStore struct {
+	dir  string
+	http *http.Client
+}
+
+func newImageStore(dir string) (*imageStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &imageStore{dir: dir, http: &http.Client{Timeout: 60 * time.Second}}, nil
+}
+
+// defaultImageDir returns the per-user cache directory for processed images.
+func defaultImageDir() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "dimalimbo", "backgrounds")
+}
+
+// Ingest fetches src, processes it and returns the content hash it is stored under.
+func (s *imageStore) Ingest(ctx context.Context, src string, opts processOptions) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("downloading image: %s", resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(raw) > maxImageBytes {
+		return "", errors.New("downloaded image is too large")
+	}
+	out, err := processImage(raw, opts)
+	if err != nil {
+		return "", err
+	}
+	return s.Put(out, opts.Format)
+}
+
+// Put stores encoded image bytes of the given format and returns their hash.
+func (s *imageStore) Put(data []byte, format string) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:16])
+	path := filepath.Join(s.dir, hash+"."+format)
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+	tmp, err := os.CreateTemp(s.dir, hash+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return hash, os.Rename(tmp.Name(), path)
+}
+
+// Remove deletes the stored image with the given hash in any format.
+func (s *imageStore) Remove(hash string) {
+	for format := range imageTypes {
+		_ = os.Remove(filepath.Join(s.dir, hash+"."+format))
+	}
+}
+
+// ServeHTTP serves /images/{hash} with long-lived, immutable caching headers.
+func (s *imageStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if len(hash) != 32 {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	for format, ctype := range imageTypes {
+		f, err := os.Open(filepath.Join(s.dir, hash+"."+format))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			break
+		}
+		w.Header().Set("Content-Type", ctype)
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("ETag", `"`+hash+`"`)
+		http.ServeContent(w, r, "", st.ModTime(), f)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// processImage decodes raw, applies opts and re-encodes it. WebP sources
+// are decoded, but the Go image libraries cannot encode WebP, so the output
+// is always JPEG or PNG.
+func processImage(raw []byte, opts processOptions) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("decoding image: %w", err)
+	}
+	b := src.Bounds()
+	resize := opts.Width > 0 && opts.Height > 0 && (opts.Width != b.Dx() || opts.Height != b.Dy())
+	var img *image.RGBA
+	if resize {
+		img = image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+		draw.CatmullRom.Scale(img, img.Bounds(), src, coverRect(b, opts.Width, opts.Height), draw.Src, nil)
+	} else {
+		img = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(img, img.Bounds(), src, b.Min, draw.Src)
+	}
+	if opts.filtered() {
+		applyLook(img, opts)
+	}
+
+	var buf bytes.Buffer
+	switch opts.Format {
+	case "png":
+		err = png.Encode(&buf, img)
+	default:
+		q := opts.Quality
+		if q <= 0 || q > 100 {
+			q = 88
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: q})
+	}
+	return buf.Bytes(), err
+}
+
+// coverRect returns the centred region of b with the aspect ratio of w:h, so
+// scaling it to w×h fills the output without distortion.
+func coverRect(b image.Rectangle, w, h int) image.Rectangle {
+	sw, sh := b.Dx(), b.Dy()
+	if sw*h > sh*w {
+		cw := sh * w / h
+		x := b.Min.X + (sw-cw)/2
+		return image.Rect(x, b.Min.Y, x+cw, b.Max.Y)
+	}
+	ch := sw * h / w
+	y := b.Min.Y + (sh-ch)/2
+	return image.Rect(b.Min.X, y, b.Max.X, y+ch)
+}
+
+// applyLook desaturates, darkens and vignettes img in place.
+func applyLook(img *image.RGBA, o processOptions) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	bright := 1 - clamp01(o.Darken)
+	desat := clamp01(o.Desaturate)
+	vig := clamp01(o.Vignette)
+	for y := 0; y < h; y++ {
+		ny := (float64(y)/float64(h) - 0.5) * 2
+		for x := 0; x < w; x++ {
+			nx := (float64(x)/float64(w) - 0.5) * 2
+			// 0 at the centre, 1 at the corners
+			d := math.Sqrt(nx*nx+ny*ny) / math.Sqrt2
+			edge := d * d * (3 - 2*d)
+			k := bright * (1 - vig*edge)
+
+			c := img.RGBAAt(x, y)
+			r, g, bl := float64(c.R), float64(c.G), float64(c.B)
+			l := 0.299*r + 0.587*g + 0.114*bl
+			r += (l - r) * desat
+			g += (l - g) * desat
+			bl += (l - bl) * desat
+			img.SetRGBA(x, y, color.RGBA{R: uint8(r * k), G: uint8(g * k), B: uint8(bl * k), A: c.A})
+		}
+	}
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// providerSize fits w×h within the provider's supported range (256–1440 per
+// side, multiples of 32) keeping the aspect ratio; the result is resized back
+// to w×h after download.
+func providerSize(w, h int) (int, int) {
+	const lo, hi, step = 256, 1440, 32
+	fw, fh := float64(w), float64(h)
+	if s := float64(hi) / math.Max(fw, fh); s < 1 {
+		fw, fh = fw*s, fh*s
+	}
+	snap := func(v float64) int {
+		n := int(math.Round(v/step)) * step
+		return max(lo, min(hi, n))
+	}
+	return snap(fw), snap(fh)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/stoneresearch/dimalimbo/internal/bgapi"
+	"github.com/stoneresearch/dimalimbo/internal/bgservice"
+)
+
+var (
+	errQueueFull    = errors.New("generation queue is full")
+	errShuttingDown = errors.New("server is shutting down")
+)
+
+type job struct {
+	view      bgservice.Job
+	req       reqBody
+	requestID string // of the request that created the job
+	subs      map[chan bgservice.Job]struct{}
+}
+
+// generateFunc produces an image URL for a request, reporting progress as it goes.
+type generateFunc func(ctx context.Context, rb reqBody, progress bgapi.ProgressFunc) (string, error)
+
+// jobQueue runs background generations on a fixed number of workers fed by a
+// bounded queue, so concurrent players cannot fan out into unbounded provider calls.
+type jobQueue struct {
+	mu      sync.Mutex
+	jobs    map[string]*job
+	pending chan *job
+	gen     generateFunc
+	timeout time.Duration
+	ttl     time.Duration
+	closed  bool
+
+	quit   chan struct{}      // closed to stop workers between jobs
+	cancel context.CancelFunc // aborts in-flight generations
+	wg     sync.WaitGroup
+}
+
+func newJobQueue(gen generateFunc, depth int, timeout time.Duration) *jobQueue {
+	if depth < 1 {
+		depth = 1
+	}
+	return &jobQueue{
+		jobs:    make(map[string]*job),
+		pending: make(chan *job, depth),
+		gen:     gen,
+		timeout: timeout,
+		ttl:     10 * time.Minute,
+		quit:    make(chan struct{}),
+	}
+}
+
+// Start launches n workers that run until Shutdown.
+func (q *jobQueue) Start(n int) {
+	if n < 1 {
+		n = 1
+	}
+	var ctx context.Context
+	ctx, q.cancel = context.WithCancel(context.Background())
+	for i := 0; i < n; i++ {
+		q.wg.Add(1)
+		go q.worker(ctx)
+	}
+}
+
+func (q *jobQueue) worker(ctx context.Context) {
+	defer q.wg.Done()
+	for {
+		// prefer quitting over picking up more work
+		select {
+		case <-q.quit:
+			return
+		default:
+		}
+		select {
+		case <-q.quit:
+			return
+		case j := <-q.pending:
+			q.run(ctx, j)
+		}
+	}
+}
+
+// Shutdown stops accepting jobs, fails those still queued and waits for
+// in-flight generations to finish. If ctx ends first, in-flight generations
+// are cancelled (which also cancels them at the provider) before returning.
+func (q *jobQueue) Shutdown(ctx context.Context) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.quit)
+	q.mu.Unlock()
+
+	for drained := false; !drained; {
+		select {
+		case j := <-q.pending:
+			q.update(j, func(v *bgservice.Job) {
+				v.Status = bgservice.StatusFailed
+				v.Error = errShuttingDown.Error()
+			})
+		default:
+			drained = true
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if q.cancel != nil {
+			q.cancel()
+		}
+		<-done
+	}
+	if q.cancel != nil {
+		q.cancel()
+	}
+}
+
+func (q *jobQueue) run(ctx context.Context, j *job) {
+	q.update(j, func(v *bgservice.Job) { v.Status = bgservice.StatusRunning })
+	ctx, cancel := context.WithTimeout(bgapi.WithRequestID(ctx, j.requestID), q.timeout)
+	defer cancel()
+	url, err := q.gen(ctx, j.req, func(_ string, p float64) {
+		q.update(j, func(v *bgservice.Job) {
+			if p > v.Progress && p < 1 {
+				v.Progress = p
+			}
+		})
+	})
+	q.update(j, func(v *bgservice.Job) {
+		v.Progress = 1
+		if err != nil {
+			v.Status = bgservice.StatusFailed
+			v.Error = err.Error()
+			return
+		}
+		v.Status = bgservice.StatusSucceeded
+		v.URL = url
+	})
+	if err != nil {
+		slog.Warn("job failed", "job", j.view.ID, "request_id", j.requestID, "error", err, "class", bgapi.Class(err))
+	}
+}
+
+// Submit enqueues a generation and returns its initial view, or errQueueFull
+// when the queue has no room left.
+func (q *jobQueue) Submit(rb reqBody, requestID string) (bgservice.Job, error) {
+	now := time.Now()
+	j := &job{
+		view:      bgservice.Job{ID: newJobID(), Status: bgservice.StatusQueued, CreatedAt: now, UpdatedAt: now},
+		req:       rb,
+		requestID: requestID,
+		subs:      make(map[chan bgservice.Job]struct{}),
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return bgservice.Job{}, errShuttingDown
+	}
+	q.prune(now)
+	select {
+	case q.pending <- j:
+	default:
+		return bgservice.Job{}, errQueueFull
+	}
+	q.jobs[j.view.ID] = j
+	return j.view, nil
+}
+
+// Complete records a job that was satisfied without generating, such as one
+// answered from the pre-generated pool.
+func (q *jobQueue) Complete(url, requestID string) bgservice.Job {
+	now := time.Now()
+	j := &job{
+		view:      bgservice.Job{ID: newJobID(), Status: bgservice.StatusSucceeded, Progress: 1, URL: url, CreatedAt: now, UpdatedAt: now},
+		requestID: requestID,
+		subs:      make(map[chan bgservice.Job]struct{}),
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune(now)
+	q.jobs[j.view.ID] = j
+	return j.view
+}
+
+// Get returns the current view of a job.
+func (q *jobQueue) Get(id string) (bgservice.Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return bgservice.Job{}, false
+	}
+	return j.view, true
+}
+
+// Wait blocks until the job finishes or ctx ends and returns its last view.
+func (q *jobQueue) Wait(ctx context.Context, id string) (bgservice.Job, error) {
+	updates, unsubscribe, ok := q.Subscribe(id)
+	if !ok {
+		return bgservice.Job{}, errors.New("unknown job")
+	}
+	defer unsubscribe()
+	var v bgservice.Job
+	for {
+		select {
+		case <-ctx.Done():
+			return v, ctx.Err()
+		case u, open := <-updates:
+			if !open {
+				return v, nil
+			}
+			v = u
+		}
+	}
+}
+
+// Depth reports how many jobs are waiting for a worker.
+func (q *jobQueue) Depth() int { return len(q.pending) }
+
+// Subscribe returns a channel that yields the job's latest view on every
+// change and is closed once the job finishes. Slow readers only ever see the
+// most recent state. The returned func unsubscribes.
+func (q *jobQueue) Subscribe(id string) (<-chan bgservice.Job, func(), bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return nil, nil, false
+	}
+	ch := make(chan bgservice.Job, 1)
+	ch <- j.view
+	if j.view.Status.Done() {
+		close(ch)
+		return ch, func() {}, true
+	}
+	j.subs[ch] = struct{}{}
+	return ch, func() {
+		q.mu.Lock()
+		if _, ok := j.subs[ch]; ok {
+			delete(j.subs, ch)
+			close(ch)
+		}
+		q.mu.Unlock()
+	}, true
+}
+
+func (q *jobQueue) update(j *job, fn func(v *bgservice.Job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fn(&j.view)
+	j.view.UpdatedAt = time.Now()
+	for ch := range j.subs {
+		// keep only the latest state for slow subscribers
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- j.view
+		if j.view.Status.Done() {
+			delete(j.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// prune drops finished jobs older than the retention window. Callers hold q.mu.
+func (q *jobQueue) prune(now time.Time) {
+	for id, j := range q.jobs {
+		if j.view.Status.Done() && now.Sub(j.view.UpdatedAt) > q.ttl {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+func newJobID() string {
+	var b [12]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -1,91 +1,267 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	mrand "math/rand"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/stoneresearch/dimalimbo/internal/bgapi"
+	"github.com/stoneresearch/dimalimbo/internal/bgservice"
+	"github.com/stoneresearch/dimalimbo/internal/prompts"
 )
 
-type reqBody struct {
-	Prompt string `json:"prompt"`
-	Width  int    `json:"width"`
-	Height int    `json:"height"`
-}
+// reqBody is a decoded API request; the server's request handling is
+// attached to it as methods.
+type reqBody bgservice.Request
 
-func loadEnvFiles(paths ...string) {
-	for _, p := range paths {
-		f, err := os.Open(p)
-		if err != nil {
-			continue
+// processOptions resolves the request's post-processing settings.
+func (rb reqBody) processOptions() processOptions {
+	o := processOptions{
+		Width:      rb.Width,
+		Height:     rb.Height,
+		Format:     rb.Format,
+		Quality:    rb.Quality,
+		Desaturate: rb.Desaturate,
+		Darken:     rb.Darken,
+		Vignette:   rb.Vignette,
+	}
+	if rb.Look == "limbo" {
+		if o.Desaturate == 0 {
+			o.Desaturate = limboLook.Desaturate
+		}
+		if o.Darken == 0 {
+			o.Darken = limboLook.Darken
 		}
-		s := bufio.NewScanner(f)
-		for s.Scan() {
-			line := strings.TrimSpace(s.Text())
-			if line == "" || strings.HasPrefix(line, "#") {
-				continue
-			}
-			if i := strings.IndexByte(line, '='); i > 0 {
-				k := strings.TrimSpace(line[:i])
-				v := strings.TrimSpace(line[i+1:])
-				_ = os.Setenv(k, v)
-			}
+		if o.Vignette == 0 {
+			o.Vignette = limboLook.Vignette
 		}
-		_ = f.Close()
 	}
+	if o.Format == "" {
+		o.Format = "jpeg"
+	}
+	return o
 }
 
-func main() {
-	loadEnvFiles(".env.local", ".env") // prefer .env.local, then .env
-	token := os.Getenv("REPLICATE_API_TOKEN")
-	if token == "" {
-		log.Println("warning: REPLICATE_API_TOKEN not set; requests will fail")
-	}
-	client := bgapi.NewClient(token, "black-forest-labs/flux-1.1-pro")
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("/api/background", func(w http.ResponseWriter, r *http.Request) {
-		// CORS
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		if r.Method != http.MethodPost {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
+// resolve fills the prompt and model parameters from the style template.
+// An explicit prompt is used verbatim, but still picks up the template's
+// parameters and look.
+func (rb *reqBody) resolve(set prompts.Set) error {
+	if rb.Seed == 0 {
+		rb.Seed = mrand.Int63n(1 << 31)
+	}
+	t, err := set.Render(rb.Style, prompts.Vars{Biome: rb.Biome, TimeOfDay: rb.TimeOfDay, Seed: rb.Seed})
+	if err != nil {
+		return err
+	}
+	if rb.Prompt == "" {
+		rb.Prompt = t.Prompt
+		if rb.NegativePrompt == "" {
+			rb.NegativePrompt = t.NegativePrompt
 		}
-		var rb reqBody
-		if json.NewDecoder(r.Body).Decode(&rb) != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+	}
+	if rb.Guidance == 0 {
+		rb.Guidance = t.Guidance
+	}
+	if rb.Steps == 0 {
+		rb.Steps = t.Steps
+	}
+	if rb.Look == "" {
+		rb.Look = t.Look
+	}
+	return nil
+}
+
+// input returns the model inputs for the request at the given provider size.
+func (rb reqBody) input(width, height int) bgapi.Input {
+	return bgapi.Input{
+		Prompt:         rb.Prompt,
+		NegativePrompt: rb.NegativePrompt,
+		Width:          width,
+		Height:         height,
+		Guidance:       rb.Guidance,
+		Steps:          rb.Steps,
+		Seed:           rb.Seed,
+	}
+}
+
+// printToken implements "bgserver token [ttl]", printing a signed token for clients.
+func printToken(auth *authenticator, args []string) {
+	ttl := 24 * time.Hour
+	if len(args) > 0 {
+		var err error
+		if ttl, err = time.ParseDuration(args[0]); err != nil {
+			fatal("invalid token ttl", "error", err)
 		}
-		if rb.Width == 0 {
-			rb.Width = 1024
+	}
+	if len(auth.secret) == 0 {
+		fatal("BG_AUTH_SECRET is not set")
+	}
+	fmt.Println(auth.signToken(time.Now(), ttl))
+}
+
+// newLogger builds the process logger from the configured format (text or
+// json) and level (debug, info, warn, error).
+func newLogger(cfg config) *slog.Logger {
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(cfg.LogLevel))
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func main() {
+	// prefer the real environment, then .env.local, then .env
+	if err := loadEnvFiles(".env.local", ".env"); err != nil {
+		fatal("reading env file", "error", err)
+	}
+	cfg, args, printOnly, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal("invalid configuration", "error", err)
+	}
+	if printOnly {
+		_ = cfg.print(os.Stdout)
+		return
+	}
+	logger := newLogger(cfg)
+	slog.SetDefault(logger)
+	auth := &authenticator{secret: []byte(cfg.AuthSecret)}
+	if len(args) > 0 && args[0] == "token" {
+		printToken(auth, args[1:])
+		return
+	}
+	if cfg.ProviderToken == "" {
+		slog.Warn("REPLICATE_API_TOKEN not set; requests will fail")
+	}
+	client := bgapi.NewClient(cfg.ProviderToken, cfg.Model)
+	client.Logger = logger
+	client.Wait = time.Duration(cfg.ProviderWait)
+	client.HTTP.Timeout = time.Duration(cfg.ProviderTimeout)
+	client.Timeout = time.Duration(cfg.JobTimeout)
+
+	templates := prompts.Defaults()
+	if cfg.PromptsFile != "" {
+		if templates, err = prompts.Load(cfg.PromptsFile); err != nil {
+			fatal("loading prompt templates", "error", err)
 		}
-		if rb.Height == 0 {
-			rb.Height = 768
+	}
+
+	images, err := newImageStore(cfg.ImageDir)
+	if err != nil {
+		fatal("creating image cache", "dir", cfg.ImageDir, "error", err)
+	}
+
+	var m *metrics
+	jobs := newJobQueue(func(ctx context.Context, rb reqBody, progress bgapi.ProgressFunc) (url string, err error) {
+		start := time.Now()
+		defer func() { m.observeGeneration(time.Since(start), err) }()
+		w, h := providerSize(rb.Width, rb.Height)
+		src, err := client.Predict(ctx, rb.input(w, h), progress)
+		if err != nil {
+			return "", err
 		}
-		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
-		defer cancel()
-		url, err := client.Generate(ctx, rb.Prompt, rb.Width, rb.Height)
+		hash, err := images.Ingest(ctx, src, rb.processOptions())
 		if err != nil {
-			w.WriteHeader(http.StatusBadGateway)
-			_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return "", err
+		}
+		return "/images/" + hash, nil
+	}, cfg.QueueSize, time.Duration(cfg.JobTimeout))
+	m = newMetrics(jobs.Depth)
+
+	if len(auth.secret) == 0 {
+		slog.Warn("BG_AUTH_SECRET not set; the API is open to anyone who can reach it")
+	}
+
+	bgPool := loadPool(galleryPath(cfg.ImageDir))
+	bgPool.size = cfg.PoolSize
+	bgPool.styles = cfg.PoolStyles
+	bgPool.width = cfg.PoolWidth
+	bgPool.height = cfg.PoolHeight
+	bgPool.budget = cfg.PoolBudgetPerHour
+	bgPool.jobs = jobs
+	bgPool.images = images
+	bgPool.templates = templates
+
+	srv := &server{
+		jobs:          jobs,
+		images:        images,
+		pool:          bgPool,
+		templates:     templates,
+		auth:          auth,
+		metrics:       m,
+		ready:         &readiness{client: client, ttl: 30 * time.Second},
+		logger:        logger,
+		limiter:       newRateLimiter(cfg.RatePerMinute, cfg.RateBurst),
+		trustProxy:    cfg.TrustProxy,
+		origins:       cfg.AllowedOrigins,
+		maxBody:       cfg.MaxBodyBytes,
+		maxPrompt:     cfg.MaxPromptChars,
+		minSize:       cfg.MinSize,
+		maxSize:       cfg.MaxSize,
+		defaultWidth:  cfg.DefaultWidth,
+		defaultHeight: cfg.DefaultHeight,
+	}
+
+	hs := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           srv.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	jobs.Start(cfg.Workers)
+	go bgPool.Run(ctx)
+
+	errc := make(chan error, 1)
+	go func() {
+		if cfg.TLSCert != "" {
+			slog.Info("BG API server listening", "addr", cfg.Addr, "tls", true, "model", cfg.Model)
+			errc <- hs.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
 			return
 		}
-		_ = json.NewEncoder(w).Encode(map[string]string{"url": url})
-	})
+		slog.Info("BG API server listening", "addr", cfg.Addr, "model", cfg.Model)
+		errc <- hs.ListenAndServe()
+	}()
 
-	addr := ":8787"
-	log.Printf("BG API server listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, mux))
+	select {
+	case err := <-errc:
+		fatal("server stopped", "error", err)
+	case <-ctx.Done():
+	}
+	stop()
+	grace := time.Duration(cfg.ShutdownGrace)
+	slog.Info("shutting down; waiting for in-flight generations", "grace", grace)
+	sctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	// Finishing jobs closes their event streams, which lets hs.Shutdown return.
+	jobsDone := make(chan struct{})
+	go func() {
+		jobs.Shutdown(sctx)
+		close(jobsDone)
+	}()
+	if err := hs.Shutdown(sctx); err != nil {
+		slog.Warn("shutdown", "error", err)
+		_ = hs.Close()
+	}
+	<-jobsDone
+	slog.Info("bye")
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stoneresearch/dimalimbo/internal/bgapi"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the generation latency histogram.
+var latencyBuckets = []float64{1, 2.5, 5, 10, 20, 30, 45, 60, 90, 120}
+
+type histogram struct {
+	counts []uint64 // per bucket, non-cumulative; the last slot is +Inf
+	sum    float64
+	count  uint64
+}
+
+// metrics collects counters and histograms and renders them in the
+// Prometheus text exposition format.
+type metrics struct {
+	mu             sync.Mutex
+	requests       map[[3]string]uint64 // method, route, code
+	generations    map[string]*histogram
+	providerErrors map[string]uint64
+	queueDepth     func() int
+}
+
+func newMetrics(queueDepth func() int) *metrics {
+	return &metrics{
+		requests:       make(map[[3]string]uint64),
+		generations:    make(map[string]*histogram),
+		providerErrors: make(map[string]uint64),
+		queueDepth:     queueDepth,
+	}
+}
+
+func (m *metrics) observeRequest(method, route string, code int) {
+	m.mu.Lock()
+	m.requests[[3]string{method, route, strconv.Itoa(code)}]++
+	m.mu.Unlock()
+}
+
+// observeGeneration records one generation's latency and, on failure, its error class.
+func (m *metrics) observeGeneration(d time.Duration, err error) {
+	outcome := "succeeded"
+	if err != nil {
+		outcome = "failed"
+	}
+	secs := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.generations[outcome]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.generations[outcome] = h
+	}
+	i := sort.SearchFloat64s(latencyBuckets, secs)
+	h.counts[i]++
+	h.sum += secs
+	h.count++
+	if err != nil {
+		m.providerErrors[bgapi.Class(err)]++
+	}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP bgserver_http_requests_total HTTP requests by method, route and status code.")
+	fmt.Fprintln(w, "# TYPE bgserver_http_requests_total counter")
+	keys := make([][3]string, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a[1] != b[1] {
+			return a[1] < b[1]
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		return a[2] < b[2]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "bgserver_http_requests_total{method=%q,route=%q,code=%q} %d\n", k[0], k[1], k[2], m.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP bgserver_generation_duration_seconds Time from a job starting to its image being ready.")
+	fmt.Fprintln(w, "# TYPE bgserver_generation_duration_seconds histogram")
+	for _, outcome := range sortedKeys(m.generations) {
+		writeHistogram(w, "bgserver_generation_duration_seconds", "outcome", outcome, m.generations[outcome])
+	}
+
+	fmt.Fprintln(w, "# HELP bgserver_provider_errors_total Failed generations by error class.")
+	fmt.Fprintln(w, "# TYPE bgserver_provider_errors_total counter")
+	for _, class := range sortedKeys(m.providerErrors) {
+		fmt.Fprintf(w, "bgserver_provider_errors_total{class=%q} %d\n", class, m.providerErrors[class])
+	}
+
+	fmt.Fprintln(w, "# HELP bgserver_queue_depth Jobs waiting for a worker.")
+	fmt.Fprintln(w, "# TYPE bgserver_queue_depth gauge")
+	fmt.Fprintf(w, "bgserver_queue_depth %d\n", m.queueDepth())
+}
+
+func writeHistogram(w io.Writer, name, label, value string, h *histogram) {
+	var cum uint64
+	for i, le := range latencyBuckets {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", name, label, value, strconv.FormatFloat(le, 'g', -1, 64), cum)
+	}
+	cum += h.counts[len(latencyBuckets)]
+	fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, label, value, cum)
+	fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", name, label, value, h.sum)
+	fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, label, value, h.count)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// statusRecorder captures the response status while staying flushable for SSE.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// instrument assigns every request an ID (reusing a valid incoming
+// X-Request-ID), carries it in the context for bgapi calls, and records a
+// structured log line and request metrics once the handler returns.
+func instrument(next http.Handler, m *metrics, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = newJobID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(bgapi.WithRequestID(r.Context(), id))
+		rec := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		m.observeRequest(r.Method, route, rec.status)
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", route),
+			slog.Int("status", rec.status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote", r.RemoteAddr),
+		)
+	})
+}
+
+// readiness reports whether the provider is configured and reachable,
+// caching the answer briefly so probes do not hammer the provider.
+type readiness struct {
+	client *bgapi.Client
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (rd *readiness) check(ctx context.Context) error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if !rd.checked.IsZero() && time.Since(rd.checked) < rd.ttl {
+		return rd.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	rd.err = rd.client.Ping(ctx)
+	rd.checked = time.Now()
+	return rd.err
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stoneresearch/dimalimbo/internal/bgservice"
+	"github.com/stoneresearch/dimalimbo/internal/prompts"
+)
+
+// poolEntry is one generated background known to the pool.
+type poolEntry struct {
+	Hash      string    `json:"hash"`
+	Style     string    `json:"style"`
+	Prompt    string    `json:"prompt"`
+	Seed      int64     `json:"seed"`
+	TimeOfDay string    `json:"timeOfDay"`
+	CreatedAt time.Time `json:"createdAt"`
+	Served    int       `json:"served"` // times handed out to players
+	Pinned    bool      `json:"pinned"` // favourite: kept forever and reused when the pool is empty
+	Banned    bool      `json:"banned"` // never handed out again; the file is deleted
+}
+
+// pool keeps a number of ready, never-served images per style, at the
+// style's default time of day, so requests for a style can be answered
+// instantly. A background loop refills it through the job queue within an
+// hourly generation budget. Entries are persisted to gallery.json next to
+// the images so pins and bans survive restarts.
+type pool struct {
+	mu      sync.Mutex
+	entries map[string]*poolEntry
+	path    string
+
+	styles        []string
+	size          int // ready images kept per style
+	width, height int
+	budget        int // generations per hour
+	spent         []time.Time
+	keepServed    int // served, unpinned entries kept for the gallery
+
+	jobs      *jobQueue
+	images    *imageStore
+	templates prompts.Set
+}
+
+func loadPool(path string) *pool {
+	p := &pool{entries: make(map[string]*poolEntry), path: path, keepServed: 200}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return p
+	}
+	var list []*poolEntry
+	if err := json.Unmarshal(b, &list); err != nil {
+		slog.Warn("ignoring unreadable gallery file", "path", path, "error", err)
+		return p
+	}
+	for _, e := range list {
+		p.entries[e.Hash] = e
+	}
+	return p
+}
+
+// matches reports whether rb can be answered from the pool: a template-based
+// request at the pool's size and time of day without custom processing.
+func (p *pool) matches(rb reqBody) bool {
+	return p.size > 0 && rb.Prompt == "" && rb.Style != "" &&
+		rb.Width == p.width && rb.Height == p.height &&
+		(rb.TimeOfDay == "" || rb.TimeOfDay == p.timeOfDay(rb.Style)) &&
+		(rb.Format == "" || rb.Format == "jpeg") && rb.Seed == 0 &&
+		rb.Biome == "" && rb.NegativePrompt == "" && rb.Guidance == 0 && rb.Steps == 0 &&
+		rb.Look == "" && rb.Desaturate == 0 && rb.Darken == 0 && rb.Vignette == 0 && rb.Quality == 0
+}
+
+// Take hands out a never-served image of style, falling back to a random
+// pinned favourite. It returns "" when neither is available.
+func (p *pool) Take(style string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var fresh, pinned []*poolEntry
+	tod := p.timeOfDay(style)
+	for _, e := range p.entries {
+		if e.Style != style || e.TimeOfDay != tod || e.Banned {
+			continue
+		}
+		if e.Served == 0 {
+			fresh = append(fresh, e)
+		} else if e.Pinned {
+			pinned = append(pinned, e)
+		}
+	}
+	var pick *poolEntry
+	switch {
+	case len(fresh) > 0:
+		sort.Slice(fresh, func(i, j int) bool { return fresh[i].CreatedAt.Before(fresh[j].CreatedAt) })
+		pick = fresh[0]
+	case len(pinned) > 0:
+		pick = pinned[rand.Intn(len(pinned))]
+	default:
+		return ""
+	}
+	pick.Served++
+	p.evict()
+	p.save()
+	return pick.Hash
+}
+
+// List returns all entries, newest first, optionally filtered by style.
+func (p *pool) List(style string) []poolEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]poolEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		if style == "" || e.Style == style {
+			out = append(out, *e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Mark updates the pinned flag of an entry and can ban it. Banning is
+// permanent: the image file is deleted so it can no longer be served.
+func (p *pool) Mark(hash string, pinned, banned *bool) (poolEntry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[hash]
+	if !ok {
+		return poolEntry{}, false
+	}
+	if pinned != nil {
+		e.Pinned = *pinned
+	}
+	if banned != nil && *banned && !e.Banned {
+		e.Banned = true
+		e.Pinned = false
+		p.images.Remove(e.Hash)
+	}
+	p.save()
+	return *e, true
+}
+
+// Run refills the pool until ctx ends.
+func (p *pool) Run(ctx context.Context) {
+	if p.size <= 0 || len(p.styles) == 0 {
+		return
+	}
+	t := time.NewTicker(15 * time.Second)
+	defer t.Stop()
+	for {
+		for _, style := range p.styles {
+			if ctx.Err() != nil {
+				return
+			}
+			// refills wait for an empty queue so players are never turned away for them
+			if p.fresh(style) >= p.size || p.jobs.Depth() > 0 || !p.budgetLeft() {
+				continue
+			}
+			p.generate(ctx, style)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (p *pool) generate(ctx context.Context, style string) {
+	rb := reqBody{Style: style, Width: p.width, Height: p.height, Format: "jpeg"}
+	if err := rb.resolve(p.templates); err != nil {
+		slog.Warn("pool: resolving template", "style", style, "error", err)
+		return
+	}
+	v, err := p.jobs.Submit(rb, "")
+	if err == nil {
+		// only a submitted job costs a generation
+		p.spend()
+		v, err = p.jobs.Wait(ctx, v.ID)
+	}
+	if err == nil && v.Status != bgservice.StatusSucceeded {
+		err = errors.New(v.Error)
+	}
+	if err != nil {
+		slog.Warn("pool: generation failed", "style", style, "error", err)
+		return
+	}
+	hash := strings.TrimPrefix(v.URL, "/images/")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[hash]; ok && e.Banned {
+		p.images.Remove(hash)
+		return
+	}
+	p.entries[hash] = &poolEntry{Hash: hash, Style: style, Prompt: rb.Prompt, Seed: rb.Seed, TimeOfDay: p.timeOfDay(style), CreatedAt: time.Now()}
+	p.save()
+	slog.Info("pool: added background", "style", style, "hash", hash)
+}
+
+// timeOfDay is the default time of day of style's template, the one pool
+// images of the style are generated at.
+func (p *pool) timeOfDay(style string) string {
+	t, ok := p.templates[style]
+	if !ok {
+		t = p.templates["default"]
+	}
+	return t.TimeOfDay
+}
+
+// fresh counts never-served entries of style.
+func (p *pool) fresh(style string) int {
+	tod := p.timeOfDay(style)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, e := range p.entries {
+		if e.Style == style && e.TimeOfDay == tod && e.Served == 0 && !e.Banned {
+			n++
+		}
+	}
+	return n
+}
+
+// budgetLeft reports whether the hourly budget has a generation left.
+func (p *pool) budgetLeft() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cutoff := time.Now().Add(-time.Hour)
+	kept := p.spent[:0]
+	for _, t := range p.spent {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	p.spent = kept
+	return len(p.spent) < p.budget
+}
+
+// spend takes one generation from the hourly budget.
+func (p *pool) spend() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.spent = append(p.spent, time.Now())
+}
+
+// evict deletes the oldest served, unpinned entries beyond keepServed.
+// Callers hold p.mu.
+func (p *pool) evict() {
+	var served []*poolEntry
+	for _, e := range p.entries {
+		if e.Served > 0 && !e.Pinned && !e.Banned {
+			served = append(served, e)
+		}
+	}
+	if len(served) <= p.keepServed {
+		return
+	}
+	sort.Slice(served, func(i, j int) bool { return served[i].CreatedAt.Before(served[j].CreatedAt) })
+	for _, e := range served[:len(served)-p.keepServed] {
+		p.images.Remove(e.Hash)
+		delete(p.entries, e.Hash)
+	}
+}
+
+// save writes the entries to disk. Callers hold p.mu.
+func (p *pool) save() {
+	list := make([]*poolEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		slog.Warn("pool: saving gallery", "error", err)
+		return
+	}
+	_ = os.Rename(tmp, p.path)
+}
+
+// galleryPath is where the pool persists its entries.
+func galleryPath(imageDir string) string {
+	return filepath.Join(imageDir, "gallery.json")
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/stoneresearch/dimalimbo/internal/bgapi"
+	"github.com/stoneresearch/dimalimbo/internal/bgservice"
+	"github.com/stoneresearch/dimalimbo/internal/prompts"
+)
+
+// server holds the HTTP handlers of the background API and their dependencies.
+type server struct {
+	jobs      *jobQueue
+	images    *imageStore
+	pool      *pool
+	templates prompts.Set
+	auth      *authenticator
+	limiter   *rateLimiter
+	metrics   *metrics
+	ready     *readiness
+	logger    *slog.Logger
+	// origins allowed to make cross-origin calls; "*" allows any.
+	origins []string
+	// trust X-Forwarded-For and X-Forwarded-Proto from a reverse proxy
+	trustProxy bool
+	// request limits
+	maxBody   int64
+	maxPrompt int
+	minSize   int
+	maxSize   int
+	// size used when a request omits width or height
+	defaultWidth  int
+	defaultHeight int
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/background", s.handleCreate)
+	mux.HandleFunc("/api/background/{id}", s.requireAuth("GET", s.handleJob))
+	mux.HandleFunc("/api/background/{id}/events", s.requireAuth("GET", s.handleEvents))
+	mux.HandleFunc("/api/backgrounds", s.requireAuth("GET", s.handleList))
+	mux.HandleFunc("/api/backgrounds/{hash}", s.requireAuth("PATCH", s.handleMark))
+	mux.HandleFunc("/gallery", s.requireAuth("GET", s.handleGallery))
+	mux.HandleFunc("/metrics", s.requireAuth("GET", s.metrics.ServeHTTP))
+	// The rest is public: images are addressed by unguessable content
+	// hashes, probes must work without credentials and the API description
+	// holds nothing that is not in the source.
+	mux.Handle("GET /images/{hash}", s.images)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("GET /readyz", s.handleReady)
+	mux.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bgservice.OpenAPI)
+	})
+	return instrument(mux, s.metrics, s.logger)
+}
+
+// handleReady reports ready only when the provider token is set and accepted.
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if err := s.ready.check(r.Context()); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// cors sets CORS headers for allowed origins and answers preflight requests.
+// It reports whether the caller should carry on handling r.
+func (s *server) cors(w http.ResponseWriter, r *http.Request, methods string) bool {
+	origin := r.Header.Get("Origin")
+	w.Header().Add("Vary", "Origin")
+	if origin != "" {
+		switch {
+		case slices.Contains(s.origins, "*"):
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		case slices.Contains(s.origins, origin):
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", methods+", OPTIONS")
+	}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	return true
+}
+
+// requireAuth applies CORS and authentication to a handler for one method.
+func (s *server) requireAuth(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.cors(w, r, method) {
+			return
+		}
+		if r.Method != method {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.auth.Check(r); err != nil {
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if !s.cors(w, r, "POST") {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.auth.Check(r); err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if wait, ok := s.limiter.Allow(clientIP(r, s.trustProxy)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxBody)
+	var rb reqBody
+	if err := json.NewDecoder(r.Body).Decode(&rb); err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if rb.Width == 0 {
+		rb.Width = s.defaultWidth
+	}
+	if rb.Height == 0 {
+		rb.Height = s.defaultHeight
+	}
+	if err := s.validate(rb); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if s.pool.matches(rb) {
+		if hash := s.pool.Take(rb.Style); hash != "" {
+			v := s.jobs.Complete("/images/"+hash, bgapi.RequestID(r.Context()))
+			v.URL = s.publicURL(r, v.URL)
+			w.Header().Set("Location", "/api/background/"+v.ID)
+			writeJSON(w, http.StatusCreated, v)
+			return
+		}
+	}
+	if err := rb.resolve(s.templates); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	v, err := s.jobs.Submit(rb, bgapi.RequestID(r.Context()))
+	if err != nil {
+		w.Header().Set("Retry-After", "5")
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	w.Header().Set("Location", "/api/background/"+v.ID)
+	writeJSON(w, http.StatusAccepted, v)
+}
+
+func (s *server) validate(rb reqBody) error {
+	if n := utf8.RuneCountInString(rb.Prompt); n > s.maxPrompt {
+		return fmt.Errorf("prompt is %d characters; the limit is %d", n, s.maxPrompt)
+	}
+	if utf8.RuneCountInString(rb.NegativePrompt) > s.maxPrompt {
+		return fmt.Errorf("negativePrompt exceeds %d characters", s.maxPrompt)
+	}
+	for _, f := range []string{rb.Style, rb.Biome, rb.TimeOfDay} {
+		if len(f) > 64 {
+			return errors.New("style, biome and timeOfDay must be at most 64 bytes")
+		}
+	}
+	if rb.Width < s.minSize || rb.Width > s.maxSize || rb.Height < s.minSize || rb.Height > s.maxSize {
+		return fmt.Errorf("width and height must be between %d and %d", s.minSize, s.maxSize)
+	}
+	if rb.Format != "" && imageTypes[rb.Format] == "" {
+		return errors.New("format must be jpeg or png")
+	}
+	if rb.Steps < 0 || rb.Steps > 100 || rb.Guidance < 0 || rb.Guidance > 20 {
+		return errors.New("steps must be 0-100 and guidance 0-20")
+	}
+	return nil
+}
+
+func (s *server) handleJob(w http.ResponseWriter, r *http.Request) {
+	v, ok := s.jobs.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown job")
+		return
+	}
+	v.URL = s.publicURL(r, v.URL)
+	writeJSON(w, http.StatusOK, v)
+}
+
+// handleEvents streams job status changes as Server-Sent Events and closes
+// once the job finishes.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	updates, unsubscribe, ok := s.jobs.Subscribe(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown job")
+		return
+	}
+	defer unsubscribe()
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case v, open := <-updates:
+			if !open {
+				return
+			}
+			v.URL = s.publicURL(r, v.URL)
+			b, _ := json.Marshal(v)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", v.Status, b)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, bgservice.ErrorResponse{Error: msg})
+}
+
+// publicURL turns a server-relative path into an absolute URL as seen by
+// the client. X-Forwarded-Proto is only believed behind a trusted proxy.
+func (s *server) publicURL(r *http.Request, path string) string {
+	if path == "" || !strings.HasPrefix(path, "/") {
+		return path
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); s.trustProxy && (p == "http" || p == "https") {
+		scheme = p
+	}
+	return scheme + "://" + r.Host + path
+}
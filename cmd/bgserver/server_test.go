@@ -0,0 +1,758 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stoneresearch/dimalimbo/internal/bgapi"
+	"github.com/stoneresearch/dimalimbo/internal/bgservice"
+	"github.com/stoneresearch/dimalimbo/internal/prompts"
+)
+
+const testSecret = "test-secret"
+
+// testServer is a bgserver with a fake provider behind httptest. Every
+// response it sends is recorded and checked against the OpenAPI document
+// when the test ends.
+type testServer struct {
+	*httptest.Server
+	srv    *server
+	client *bgservice.Client
+	rec    *recorder
+}
+
+// newTestServer starts a server with one worker and room for one queued
+// job. Generations finish at once unless gate is non-nil, in which case
+// they wait for it to be closed. Each opt adjusts the server before it
+// starts serving.
+func newTestServer(t *testing.T, gate <-chan struct{}, opts ...func(*server)) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	images, err := newImageStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := newJobQueue(fakeGenerate(images, gate), 1, 10*time.Second)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	bgPool := loadPool(filepath.Join(dir, "gallery.json"))
+	bgPool.images = images
+	bgPool.jobs = jobs
+	bgPool.templates = prompts.Defaults()
+	s := &server{
+		jobs:          jobs,
+		images:        images,
+		pool:          bgPool,
+		templates:     bgPool.templates,
+		auth:          &authenticator{secret: []byte(testSecret)},
+		limiter:       newRateLimiter(0, 1),
+		metrics:       newMetrics(jobs.Depth),
+		ready:         &readiness{ttl: time.Hour, checked: time.Now()},
+		logger:        logger,
+		origins:       []string{"*"},
+		maxBody:       1 << 16,
+		maxPrompt:     500,
+		minSize:       16,
+		maxSize:       512,
+		defaultWidth:  64,
+		defaultHeight: 32,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	rec := &recorder{next: s.routes()}
+	t.Cleanup(func() { checkContract(t, rec.exchanges()) })
+	ts := httptest.NewServer(rec)
+	t.Cleanup(ts.Close)
+	jobs.Start(1)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		jobs.Shutdown(ctx)
+	})
+	c := bgservice.NewClient(ts.URL+"/api/background", testSecret)
+	c.PollInterval = 5 * time.Millisecond
+	return &testServer{Server: ts, srv: s, client: c, rec: rec}
+}
+
+// fakeGenerate stands in for the provider: it renders a grey image twice
+// as wide as asked and runs it through the real post-processing. A prompt
+// of "fail" fails the generation.
+func fakeGenerate(images *imageStore, gate <-chan struct{}) generateFunc {
+	return func(ctx context.Context, rb reqBody, progress bgapi.ProgressFunc) (string, error) {
+		if progress != nil {
+			progress("processing", 0.5)
+		}
+		if gate != nil {
+			select {
+			case <-gate:
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+		if rb.Prompt == "fail" {
+			return "", errors.New("provider said no")
+		}
+		src := image.NewGray(image.Rect(0, 0, 2*rb.Width, rb.Height))
+		for i := range src.Pix {
+			src.Pix[i] = byte(i)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, src); err != nil {
+			return "", err
+		}
+		opts := rb.processOptions()
+		out, err := processImage(buf.Bytes(), opts)
+		if err != nil {
+			return "", err
+		}
+		hash, err := images.Put(out, opts.Format)
+		return "/images/" + hash, err
+	}
+}
+
+// get requests path on ts with the test secret and returns the response
+// with its body read.
+func (ts *testServer) get(t *testing.T, path string) (*http.Response, []byte) {
+	t.Helper()
+	return ts.do(t, http.MethodGet, path, testSecret, "")
+}
+
+func (ts *testServer) do(t *testing.T, method, path, token, body string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, b
+}
+
+// waitStatus polls the job until it reaches status.
+func (ts *testServer) waitStatus(t *testing.T, id string, status bgservice.JobStatus) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := ts.client.Job(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == status {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %s, want %s", id, job.Status, status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCreatePollAndFetchImage(t *testing.T) {
+	ts := newTestServer(t, nil)
+	job, err := ts.client.Generate(context.Background(), bgservice.Request{Style: "limbo_forest", Width: 96, Height: 48, Format: "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != bgservice.StatusSucceeded || job.Progress != 1 {
+		t.Errorf("job = %+v, want succeeded with progress 1", job)
+	}
+	if !strings.HasPrefix(job.URL, ts.URL+"/images/") {
+		t.Fatalf("url = %q, want an absolute /images/ URL", job.URL)
+	}
+
+	resp, body := ts.do(t, http.MethodGet, strings.TrimPrefix(job.URL, ts.URL), "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("image: %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cc := resp.Header.Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("Cache-Control = %q", cc)
+	}
+	img, err := png.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 96 || b.Dy() != 48 {
+		t.Errorf("image is %dx%d, want 96x48", b.Dx(), b.Dy())
+	}
+}
+
+func TestEvents(t *testing.T) {
+	gate := make(chan struct{})
+	ts := newTestServer(t, gate)
+	job, err := ts.client.Create(context.Background(), bgservice.Request{Prompt: "a cave"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != bgservice.StatusQueued {
+		t.Errorf("created job is %s, want queued", job.Status)
+	}
+
+	// EventSource clients pass the token in the query
+	resp, err := http.Get(ts.URL + "/api/background/" + job.ID + "/events?token=" + testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	var names []string
+	var last bgservice.Job
+	released := false
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		name, ok := strings.CutPrefix(sc.Text(), "event: ")
+		if !ok {
+			continue
+		}
+		if !sc.Scan() {
+			break
+		}
+		data, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			t.Fatalf("event %s has no data line", name)
+		}
+		var v any
+		if err := json.Unmarshal([]byte(data), &v); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadSpec(t).validate(v, ref("#/components/schemas/Job"), "event"); err != nil {
+			t.Error(err)
+		}
+		if err := json.Unmarshal([]byte(data), &last); err != nil {
+			t.Fatal(err)
+		}
+		if string(last.Status) != name {
+			t.Errorf("event %s carries a %s job", name, last.Status)
+		}
+		if len(names) == 0 || names[len(names)-1] != name {
+			names = append(names, name)
+		}
+		// let the generation finish once its progress has been seen
+		if name == string(bgservice.StatusRunning) && last.Progress > 0 && !released {
+			close(gate)
+			released = true
+		}
+	}
+	if n := len(names); n < 2 || names[n-2] != "running" || names[n-1] != "succeeded" {
+		t.Errorf("events = %v, want running then succeeded", names)
+	}
+	if !strings.HasPrefix(last.URL, ts.URL+"/images/") {
+		t.Errorf("final url = %q", last.URL)
+	}
+}
+
+func TestFailedJob(t *testing.T) {
+	ts := newTestServer(t, nil)
+	job, err := ts.client.Generate(context.Background(), bgservice.Request{Prompt: "fail"})
+	if err == nil || job.Status != bgservice.StatusFailed || job.Error != "provider said no" {
+		t.Errorf("job = %+v, err = %v, want a failed job", job, err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	ts := newTestServer(t, nil, func(s *server) {
+		s.pool.size = 1
+		s.pool.width, s.pool.height = 64, 32
+		hash, err := s.images.Put([]byte("jpeg bytes"), "jpeg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.pool.entries[hash] = &poolEntry{Hash: hash, Style: "limbo_forest", Prompt: "a forest", TimeOfDay: "dusk", CreatedAt: time.Now()}
+	})
+
+	// another time of day is not in the pool and is generated
+	resp, body := ts.do(t, http.MethodPost, "/api/background", testSecret, `{"style": "limbo_forest", "timeOfDay": "night"}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("night: %s %s", resp.Status, body)
+	}
+	var queued bgservice.Job
+	if err := json.Unmarshal(body, &queued); err != nil {
+		t.Fatal(err)
+	}
+	ts.waitStatus(t, queued.ID, bgservice.StatusSucceeded)
+
+	resp, body = ts.do(t, http.MethodPost, "/api/background", testSecret, `{"style": "limbo_forest", "timeOfDay": "dusk"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("dusk: %s %s", resp.Status, body)
+	}
+	if loc := resp.Header.Get("Location"); !strings.HasPrefix(loc, "/api/background/") {
+		t.Errorf("Location = %q", loc)
+	}
+
+	resp, body = ts.get(t, "/api/backgrounds?style=limbo_forest")
+	var list []bgservice.Background
+	if err := json.Unmarshal(body, &list); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("list: %s %s", resp.Status, body)
+	}
+	if len(list) != 1 || list[0].Served != 1 {
+		t.Fatalf("list = %+v, want the one served entry", list)
+	}
+	resp, body = ts.do(t, http.MethodPatch, "/api/backgrounds/"+list[0].Hash, testSecret, `{"banned": true}`)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"banned":true`) {
+		t.Errorf("ban: %s %s", resp.Status, body)
+	}
+	if resp, _ := ts.get(t, "/images/"+list[0].Hash); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("banned image: %s, want 404", resp.Status)
+	}
+}
+
+// TestPoolBudget checks that a refill the job queue turns away does not
+// use up the hourly budget.
+func TestPoolBudget(t *testing.T) {
+	gate := make(chan struct{})
+	ts := newTestServer(t, gate, func(s *server) {
+		s.pool.budget = 1
+		s.pool.width, s.pool.height = 64, 32
+	})
+	running, err := ts.client.Create(context.Background(), bgservice.Request{Prompt: "one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.waitStatus(t, running.ID, bgservice.StatusRunning)
+	queued, err := ts.client.Create(context.Background(), bgservice.Request{Prompt: "two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ts.srv.pool
+	p.generate(context.Background(), "limbo_forest")
+	if !p.budgetLeft() {
+		t.Fatal("a refill rejected by the full queue used up the budget")
+	}
+	close(gate)
+	ts.waitStatus(t, queued.ID, bgservice.StatusSucceeded)
+	p.generate(context.Background(), "limbo_forest")
+	if p.budgetLeft() {
+		t.Error("a generated refill left the budget untouched")
+	}
+	if n := p.fresh("limbo_forest"); n != 1 {
+		t.Errorf("%d fresh entries, want 1", n)
+	}
+}
+
+func TestErrorStatuses(t *testing.T) {
+	ts := newTestServer(t, nil, func(s *server) { s.maxBody = 256 })
+	for _, tc := range []struct {
+		name, method, path, token, body string
+		want                            int
+	}{
+		{"no token", "POST", "/api/background", "", `{"prompt": "a cave"}`, http.StatusUnauthorized},
+		{"wrong token", "GET", "/api/backgrounds", "nope", "", http.StatusUnauthorized},
+		{"gallery without token", "GET", "/gallery", "", "", http.StatusUnauthorized},
+		{"metrics without token", "GET", "/metrics", "", "", http.StatusUnauthorized},
+		{"bad json", "POST", "/api/background", testSecret, `{"prompt": `, http.StatusBadRequest},
+		{"too small", "POST", "/api/background", testSecret, `{"prompt": "a cave", "width": 8}`, http.StatusBadRequest},
+		{"webp", "POST", "/api/background", testSecret, `{"prompt": "a cave", "format": "webp"}`, http.StatusBadRequest},
+		{"steps", "POST", "/api/background", testSecret, `{"prompt": "a cave", "steps": 500}`, http.StatusBadRequest},
+		{"too large", "POST", "/api/background", testSecret, `{"prompt": "` + strings.Repeat("a", 300) + `"}`, http.StatusRequestEntityTooLarge},
+		{"unknown job", "GET", "/api/background/nope", testSecret, "", http.StatusNotFound},
+		{"unknown job events", "GET", "/api/background/nope/events", testSecret, "", http.StatusNotFound},
+		{"unknown background", "PATCH", "/api/backgrounds/0123456789abcdef0123456789abcdef", testSecret, `{"pinned": true}`, http.StatusNotFound},
+		{"bad mark", "PATCH", "/api/backgrounds/0123456789abcdef0123456789abcdef", testSecret, `[`, http.StatusBadRequest},
+		{"unknown image", "GET", "/images/0123456789abcdef0123456789abcdef", "", "", http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := ts.do(t, tc.method, tc.path, tc.token, tc.body)
+			if resp.StatusCode != tc.want {
+				t.Errorf("%s %s = %s %s, want %d", tc.method, tc.path, resp.Status, body, tc.want)
+			}
+		})
+	}
+
+	// the client surfaces the status and message
+	_, err := ts.client.Job(context.Background(), "nope")
+	var se *bgservice.StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusNotFound || se.Message != "unknown job" {
+		t.Errorf("err = %v, want a 404 StatusError", err)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	gate := make(chan struct{})
+	defer close(gate)
+	ts := newTestServer(t, gate)
+	running, err := ts.client.Create(context.Background(), bgservice.Request{Prompt: "one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.waitStatus(t, running.ID, bgservice.StatusRunning)
+	if _, err := ts.client.Create(context.Background(), bgservice.Request{Prompt: "two"}); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := ts.do(t, http.MethodPost, "/api/background", testSecret, `{"prompt": "three"}`)
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("full queue: %s %s, want 503 with Retry-After", resp.Status, body)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ts := newTestServer(t, nil, func(s *server) { s.limiter = newRateLimiter(1, 1) })
+	if _, err := ts.client.Create(context.Background(), bgservice.Request{Prompt: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := ts.do(t, http.MethodPost, "/api/background", testSecret, `{"prompt": "two"}`)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second create: %s %s, want 429", resp.Status, body)
+	}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err != nil || s < 1 {
+		t.Errorf("Retry-After = %q", resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestForwardedProto(t *testing.T) {
+	for _, trust := range []bool{false, true} {
+		t.Run(fmt.Sprint("trustProxy=", trust), func(t *testing.T) {
+			ts := newTestServer(t, nil, func(s *server) { s.trustProxy = trust })
+			job, err := ts.client.Generate(context.Background(), bgservice.Request{Prompt: "a cave"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/background/"+job.ID, nil)
+			req.Header.Set("Authorization", "Bearer "+testSecret)
+			req.Header.Set("X-Forwarded-Proto", "https")
+			resp, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.HasPrefix(job.URL, "https://"); got != trust {
+				t.Errorf("url = %q with trustProxy %v", job.URL, trust)
+			}
+		})
+	}
+}
+
+// TestOpenAPI drives every documented operation once, so that the
+// contract check at the end of the test covers the whole document, and
+// checks that the Go types only carry documented fields.
+func TestOpenAPI(t *testing.T) {
+	ts := newTestServer(t, nil)
+	job, err := ts.client.Generate(context.Background(), bgservice.Request{Prompt: "a cave"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := strings.TrimPrefix(job.URL, ts.URL+"/images/")
+	ts.srv.pool.mu.Lock()
+	ts.srv.pool.entries[hash] = &poolEntry{Hash: hash, Style: "limbo_forest", Prompt: "a cave", CreatedAt: time.Now()}
+	ts.srv.pool.mu.Unlock()
+
+	ts.get(t, "/api/background/"+job.ID+"/events")
+	ts.get(t, "/api/backgrounds")
+	ts.do(t, http.MethodPatch, "/api/backgrounds/"+hash, testSecret, `{"pinned": true}`)
+	for _, path := range []string{"/images/" + hash, "/gallery", "/healthz", "/readyz", "/metrics", "/openapi.json"} {
+		if resp, body := ts.get(t, path); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: %s %s", path, resp.Status, body)
+		}
+	}
+	if resp, _ := ts.get(t, "/openapi.json"); resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("openapi.json Content-Type = %q", resp.Header.Get("Content-Type"))
+	}
+	if resp, _ := ts.do(t, http.MethodDelete, "/api/backgrounds/"+hash, testSecret, ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE /api/backgrounds/{hash}: %s, want 405", resp.Status)
+	}
+
+	sp := loadSpec(t)
+	seen := make(map[string]bool)
+	for _, x := range ts.rec.exchanges() {
+		if path, _ := sp.match(x.path); path != "" {
+			seen[x.method+" "+path] = true
+		}
+	}
+	for path, item := range sp.object("paths") {
+		for method := range item.(map[string]any) {
+			if op := strings.ToUpper(method) + " " + path; !seen[op] {
+				t.Errorf("%s is documented but was not exercised", op)
+			}
+		}
+	}
+
+	yes, now := true, time.Now()
+	for _, tc := range []struct {
+		schema string
+		v      any
+	}{
+		{"Request", bgservice.Request{Prompt: "p", Width: 1, Height: 1, Style: "s", Biome: "b", TimeOfDay: "t", NegativePrompt: "n",
+			Guidance: 1, Steps: 1, Seed: 1, Format: "png", Quality: 1, Look: "limbo", Desaturate: 1, Darken: 1, Vignette: 1}},
+		{"Job", bgservice.Job{ID: "i", Status: bgservice.StatusFailed, Progress: 1, URL: "u", Error: "e", CreatedAt: now, UpdatedAt: now}},
+		{"Background", bgservice.Background{Hash: "h", Style: "s", Prompt: "p", Seed: 1, CreatedAt: now, Served: 1, Pinned: true, Banned: true, URL: "u"}},
+		{"Mark", bgservice.Mark{Pinned: &yes, Banned: &yes}},
+		{"ErrorResponse", bgservice.ErrorResponse{Error: "e"}},
+	} {
+		b, _ := json.Marshal(tc.v)
+		var v any
+		_ = json.Unmarshal(b, &v)
+		if err := sp.validate(v, ref("#/components/schemas/"+tc.schema), tc.schema); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// exchange is one request the test server answered.
+type exchange struct {
+	method, path string
+	status       int
+	header       http.Header
+	body         []byte
+}
+
+// recorder keeps a copy of every response next sends.
+type recorder struct {
+	next http.Handler
+	mu   sync.Mutex
+	seen []exchange
+}
+
+func (rc *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tw := &teeWriter{ResponseWriter: w}
+	rc.next.ServeHTTP(tw, r)
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	rc.mu.Lock()
+	rc.seen = append(rc.seen, exchange{r.Method, r.URL.Path, tw.status, w.Header().Clone(), tw.body.Bytes()})
+	rc.mu.Unlock()
+}
+
+func (rc *recorder) exchanges() []exchange {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return slices.Clone(rc.seen)
+}
+
+type teeWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *teeWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *teeWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *teeWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// checkContract checks each exchange against the OpenAPI document: the
+// route and method are documented, the status is one of the operation's
+// responses, documented headers are set, and JSON bodies match their
+// schema.
+func checkContract(t *testing.T, xs []exchange) {
+	t.Helper()
+	sp := loadSpec(t)
+	for _, x := range xs {
+		if x.status == http.StatusMethodNotAllowed || x.status == http.StatusNoContent && x.method == http.MethodOptions {
+			continue
+		}
+		at := fmt.Sprintf("%s %s -> %d", x.method, x.path, x.status)
+		path, item := sp.match(x.path)
+		if path == "" {
+			t.Errorf("%s: path is not documented", at)
+			continue
+		}
+		op, ok := item[strings.ToLower(x.method)].(map[string]any)
+		if !ok {
+			t.Errorf("%s: method is not documented for %s", at, path)
+			continue
+		}
+		resp, ok := op["responses"].(map[string]any)[strconv.Itoa(x.status)].(map[string]any)
+		if !ok {
+			t.Errorf("%s: status is not documented", at)
+			continue
+		}
+		resp = sp.resolve(resp)
+		for name := range sp.sub(resp, "headers") {
+			if x.header.Get(name) == "" {
+				t.Errorf("%s: missing %s header", at, name)
+			}
+		}
+		content := sp.sub(resp, "content")
+		if len(content) == 0 {
+			continue
+		}
+		ctype, _, _ := mime.ParseMediaType(x.header.Get("Content-Type"))
+		media, ok := content[ctype].(map[string]any)
+		if !ok {
+			t.Errorf("%s: Content-Type %q is not documented", at, ctype)
+			continue
+		}
+		schema, ok := media["schema"].(map[string]any)
+		if !ok || ctype != "application/json" {
+			continue
+		}
+		var v any
+		if err := json.Unmarshal(x.body, &v); err != nil {
+			t.Errorf("%s: %v", at, err)
+			continue
+		}
+		if err := sp.validate(v, schema, at); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// spec is the decoded OpenAPI document.
+type spec map[string]any
+
+func loadSpec(t *testing.T) spec {
+	t.Helper()
+	var sp spec
+	if err := json.Unmarshal(bgservice.OpenAPI, &sp); err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+func ref(to string) map[string]any { return map[string]any{"$ref": to} }
+
+func (sp spec) object(key string) map[string]any { return sp.sub(sp, key) }
+
+func (sp spec) sub(m map[string]any, key string) map[string]any {
+	v, _ := m[key].(map[string]any)
+	return v
+}
+
+// resolve follows m's $ref, if it has one.
+func (sp spec) resolve(m map[string]any) map[string]any {
+	to, ok := m["$ref"].(string)
+	if !ok {
+		return m
+	}
+	cur := map[string]any(sp)
+	for _, part := range strings.Split(strings.TrimPrefix(to, "#/"), "/") {
+		cur = sp.sub(cur, part)
+	}
+	return cur
+}
+
+// match finds the documented path template that path falls under.
+func (sp spec) match(path string) (string, map[string]any) {
+	segs := strings.Split(path, "/")
+	for tmpl, item := range sp.object("paths") {
+		want := strings.Split(tmpl, "/")
+		if len(want) != len(segs) {
+			continue
+		}
+		ok := true
+		for i, w := range want {
+			if w != segs[i] && !(strings.HasPrefix(w, "{") && segs[i] != "") {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return tmpl, item.(map[string]any)
+		}
+	}
+	return "", nil
+}
+
+// validate checks a decoded JSON value against the subset of JSON Schema
+// the document uses. Objects may only carry documented properties.
+func (sp spec) validate(v any, schema map[string]any, at string) error {
+	schema = sp.resolve(schema)
+	if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, v) {
+		return fmt.Errorf("%s: %v is not one of %v", at, v, enum)
+	}
+	switch schema["type"] {
+	case "object":
+		m, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: %v is not an object", at, v)
+		}
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := m[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing %s", at, name)
+			}
+		}
+		props := sp.sub(schema, "properties")
+		for name, val := range m {
+			ps, ok := props[name].(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: %s is not documented", at, name)
+			}
+			if err := sp.validate(val, ps, at+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		a, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s: %v is not an array", at, v)
+		}
+		for i, item := range a {
+			if err := sp.validate(item, sp.sub(schema, "items"), fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s: %v is not a string", at, v)
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != math.Trunc(f) {
+			return fmt.Errorf("%s: %v is not an integer", at, v)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("%s: %v is not a number", at, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: %v is not a boolean", at, v)
+		}
+	}
+	return nil
+}
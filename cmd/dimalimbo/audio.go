@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/stoneresearch/dimalimbo/internal/audio"
+)
+
+// runAudio implements "dimalimbo audio", which renders the game's music
+// and sound effects offline; it needs no sound card.
+func runAudio(args []string) error {
+	if len(args) == 0 {
+		return errors.New("audio: want a command: render or hash")
+	}
+	switch args[0] {
+	case "render":
+		return renderAudio(args[1:])
+	case "hash":
+		return hashAudio(args[1:])
+	}
+	return fmt.Errorf("audio: unknown command %q (want render or hash)", args[0])
+}
+
+// renderAudio implements "dimalimbo audio render".
+func renderAudio(args []string) error {
+	fs := flag.NewFlagSet("audio render", flag.ContinueOnError)
+	style := fs.String("style", "", "song to render: "+strings.Join(audio.SongNames(), ", ")+", or a .json or .mid song file")
+	sfx := fs.String("sfx", "", "sound effect to render instead: one the game plays ("+strings.Join(audio.GameEffects(), ", ")+") or a preset ("+strings.Join(audio.EffectKinds, ", ")+")")
+	seed := fs.Int64("seed", 0, "render a random variation of the --sfx preset (0 = the preset itself)")
+	out := fs.String("out", "", `WAV file to write ("-" for stdout)`)
+	rate := fs.Int("rate", 44100, "sample rate in Hz")
+	bits := fs.Int("bits", 16, "bits per sample: 16 or 24")
+	channels := fs.Int("channels", 2, "1 for mono, 2 for stereo")
+	loops := fs.Int("loops", 1, "times to repeat the song")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: dimalimbo audio render (--style NAME | --sfx NAME) --out FILE [flags]\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch {
+	case (*style == "") == (*sfx == ""):
+		return errors.New("audio render: want one of --style or --sfx")
+	case *out == "":
+		return errors.New("audio render: --out is required")
+	case *channels != 1 && *channels != 2:
+		return fmt.Errorf("audio render: --channels must be 1 or 2, not %d", *channels)
+	case *rate < 8000 || *rate > 192000:
+		return fmt.Errorf("audio render: --rate must be 8000-192000, not %d", *rate)
+	}
+	var pcm audio.PCM
+	var err error
+	if *style != "" {
+		pcm, err = audio.RenderSong(*style, *rate, *loops)
+	} else {
+		pcm, err = audio.RenderEffect(*sfx, *seed, *rate)
+	}
+	if err != nil {
+		return fmt.Errorf("audio render: %w", err)
+	}
+	if *channels == 2 {
+		pcm = pcm.Stereo()
+	} else {
+		pcm = pcm.Mono()
+	}
+	var buf bytes.Buffer
+	if err := pcm.WriteWAV(&buf, *bits); err != nil {
+		return fmt.Errorf("audio render: %w", err)
+	}
+	if *out == "-" {
+		_, err = io.Copy(os.Stdout, &buf)
+		return err
+	}
+	return os.WriteFile(*out, buf.Bytes(), 0o644)
+}
+
+// hashAudio implements "dimalimbo audio hash", which prints the hashes of
+// every built-in song and effect.
+func hashAudio(args []string) error {
+	fs := flag.NewFlagSet("audio hash", flag.ContinueOnError)
+	rate := fs.Int("rate", 44100, "sample rate in Hz")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	got, err := audio.Hashes(*rate)
+	if err != nil {
+		return fmt.Errorf("audio hash: %w", err)
+	}
+	_, err = os.Stdout.Write(got)
+	return err
+}
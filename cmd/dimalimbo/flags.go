@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stoneresearch/dimalimbo/internal/game"
+	"github.com/stoneresearch/dimalimbo/internal/paths"
+	"github.com/stoneresearch/dimalimbo/internal/settings"
+	"github.com/stoneresearch/dimalimbo/internal/storage"
+)
+
+// options are the parsed command line.
+type options struct {
+	config     string
+	db         string
+	fullscreen bool
+	windowed   bool
+	lowPower   bool
+	portable   bool
+	seed       int64
+	mode       string
+	difficulty string
+	profile    *profileRef // shared with the title screen's profile picker
+	sets       setFlags
+	given      map[string]bool // flags present on the command line
+	args       []string        // command, e.g. "paths"
+}
+
+// setFlags collects repeated --set key=value overrides.
+type setFlags [][2]string
+
+func (f *setFlags) String() string { return "" }
+
+func (f *setFlags) Set(v string) error {
+	k, val, ok := strings.Cut(v, "=")
+	if !ok || k == "" {
+		return errors.New("want key=value")
+	}
+	*f = append(*f, [2]string{k, val})
+	return nil
+}
+
+// profileRef is the active settings profile. The title screen can switch
+// it while the settings watcher reloads in the background.
+type profileRef struct {
+	mu   sync.Mutex
+	name string
+}
+
+func (p *profileRef) get() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.name
+}
+
+func (p *profileRef) set(name string) {
+	p.mu.Lock()
+	p.name = name
+	p.mu.Unlock()
+}
+
+func parseFlags(args []string) (options, error) {
+	opts := options{given: make(map[string]bool), profile: &profileRef{}}
+	fs := flag.NewFlagSet("dimalimbo", flag.ContinueOnError)
+	fs.StringVar(&opts.config, "config", os.Getenv("DIMALIMBO_CONFIG"), "settings file (env DIMALIMBO_CONFIG; default in the config dir)")
+	fs.StringVar(&opts.db, "db", "", "leaderboard database path")
+	fs.BoolVar(&opts.fullscreen, "fullscreen", false, "start fullscreen")
+	fs.BoolVar(&opts.windowed, "windowed", false, "start in a window")
+	fs.BoolVar(&opts.lowPower, "low-power", false, "disable post-processing and heavy effects")
+	fs.BoolVar(&opts.portable, "portable", false, "keep settings and data next to the executable (env DIMALIMBO_PORTABLE)")
+	fs.Int64Var(&opts.seed, "seed", 0, "fixed random seed for reproducible runs (0 = random)")
+	fs.StringVar(&opts.mode, "mode", "title", "start screen: title, play or leaderboard")
+	fs.StringVar(&opts.profile.name, "profile", os.Getenv("DIMALIMBO_PROFILE"), "settings profile to use (env DIMALIMBO_PROFILE; default from the settings file)")
+	fs.StringVar(&opts.difficulty, "difficulty", "", "difficulty preset: "+strings.Join(settings.PresetNames, ", "))
+	fs.Var(&opts.sets, "set", "override a setting, e.g. --set baseSpeed=5 (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: dimalimbo [flags] [paths | audio render | audio hash]\n\nSettings are read from the settings file, then DIMALIMBO_<KEY> environment\nvariables (e.g. DIMALIMBO_MASTER_VOLUME=0.5), then --set, then the flags below.\n\"dimalimbo paths\" prints where settings and data are kept; \"dimalimbo audio\nrender -h\" shows how to render the music and sound effects to WAV.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	fs.Visit(func(f *flag.Flag) { opts.given[f.Name] = true })
+	opts.args = fs.Args()
+	if opts.fullscreen && opts.windowed {
+		return opts, errors.New("--fullscreen and --windowed are mutually exclusive")
+	}
+	if _, ok := settings.Presets[opts.difficulty]; opts.difficulty != "" && !ok {
+		return opts, fmt.Errorf("unknown --difficulty %q (want %s)", opts.difficulty, strings.Join(settings.PresetNames, ", "))
+	}
+	return opts, nil
+}
+
+// legacyMoves lists the files that older versions kept in the working
+// directory, which are looked for there and beside the executable, with
+// their new homes. A settings.json must hold known settings and a
+// dimalimbo.db the leaderboard, so that files of those names belonging to
+// something else stay put. Files chosen explicitly on the command line
+// stay put too, and nothing moves in portable mode.
+func (o options) legacyMoves(dirs paths.Dirs) []paths.Move {
+	var moves []paths.Move
+	if dirs.Portable {
+		return moves
+	}
+	if o.config == "" {
+		for _, src := range dirs.Legacy("settings.json") {
+			moves = append(moves, paths.Move{Src: src, Dst: dirs.Settings(), Check: func() bool { return settings.Recognize(src) }})
+		}
+	}
+	if !o.given["db"] {
+		for _, db := range dirs.Legacy("dimalimbo.db") {
+			// the journal files follow the database they belong to
+			check := func() bool { return storage.IsLeaderboard(db) }
+			for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+				moves = append(moves, paths.Move{Src: db + suffix, Dst: dirs.DB() + suffix, Check: check})
+			}
+		}
+	}
+	return moves
+}
+
+// settings resolves the settings from, lowest precedence first: the
+// built-in defaults, the settings file, the active profile, DIMALIMBO_*
+// environment variables, --set overrides and the dedicated flags. A
+// relative dbPath or musicDir setting is taken relative to the data dir, a
+// relative sfxFile relative to the settings file. Problems with
+// the settings file and clamped values are returned as warnings; the
+// settings are still usable.
+func (o options) settings(dirs paths.Dirs) (cfg settings.Settings, warn, err error) {
+	cfg, warn = settings.LoadProfile(o.settingsPath(dirs), o.profile.get())
+	if err := cfg.ApplyEnv(os.Environ()); err != nil {
+		return cfg, warn, err
+	}
+	for _, kv := range o.sets {
+		if err := cfg.Set(kv[0], kv[1]); err != nil {
+			return cfg, warn, fmt.Errorf("--set: %w", err)
+		}
+	}
+	if !filepath.IsAbs(cfg.DBPath) {
+		cfg.DBPath = filepath.Join(dirs.Data, cfg.DBPath)
+	}
+	if !filepath.IsAbs(cfg.MusicDir) {
+		cfg.MusicDir = filepath.Join(dirs.Data, cfg.MusicDir)
+	}
+	if cfg.SFXFile != "" && !filepath.IsAbs(cfg.SFXFile) {
+		cfg.SFXFile = filepath.Join(filepath.Dir(o.settingsPath(dirs)), cfg.SFXFile)
+	}
+	if o.given["db"] {
+		cfg.DBPath = o.db
+	}
+	if o.given["fullscreen"] {
+		cfg.Fullscreen = o.fullscreen
+	}
+	if o.given["windowed"] {
+		cfg.Fullscreen = !o.windowed
+	}
+	if o.given["low-power"] {
+		cfg.LowPower = o.lowPower
+	}
+	if o.difficulty != "" {
+		_ = cfg.ApplyPreset(o.difficulty) // checked by parseFlags
+	}
+	if err := cfg.Validate(); err != nil {
+		warn = errors.Join(warn, fmt.Errorf("overrides: %w", err))
+	}
+	return cfg, warn, nil
+}
+
+// settingsPath is the settings file in use.
+func (o options) settingsPath(dirs paths.Dirs) string {
+	if o.config != "" {
+		return o.config
+	}
+	return dirs.Settings()
+}
+
+// watchSettings re-resolves the settings whenever the settings file changes.
+func (o options) watchSettings(ctx context.Context, dirs paths.Dirs) <-chan game.SettingsUpdate {
+	out := make(chan game.SettingsUpdate, 1)
+	changes := settings.Watch(ctx, o.settingsPath(dirs), time.Second)
+	go func() {
+		defer close(out)
+		for range changes {
+			select {
+			case out <- o.update(dirs):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// loadProfile switches the active profile and resolves its settings; the
+// title screen's profile picker calls it.
+func (o options) loadProfile(dirs paths.Dirs) func(string) game.SettingsUpdate {
+	return func(name string) game.SettingsUpdate {
+		prev := o.profile.get()
+		o.profile.set(name)
+		u := o.update(dirs)
+		if u.Err != nil {
+			o.profile.set(prev)
+		}
+		return u
+	}
+}
+
+// update resolves the settings for the game; an unusable settings file is an
+// error rather than a warning, so the game keeps what it has.
+func (o options) update(dirs paths.Dirs) game.SettingsUpdate {
+	cfg, warn, err := o.settings(dirs)
+	u := game.SettingsUpdate{Settings: cfg, Warn: warn, Err: err}
+	if errors.Is(warn, settings.ErrUnusable) {
+		u.Err, u.Warn = warn, nil
+	}
+	return u
+}
+
+// printPaths implements "dimalimbo paths".
+func printPaths(dirs paths.Dirs, o options) {
+	cfgPath := o.settingsPath(dirs)
+	mode := "per-user"
+	if dirs.Portable {
+		mode = "portable"
+	}
+	fmt.Printf("mode:     %s\n", mode)
+	fmt.Printf("settings: %s\n", cfgPath)
+	fmt.Printf("data:     %s\n", dirs.Data)
+	fmt.Printf("cache:    %s\n", dirs.Cache)
+	if cfg, _, err := o.settings(dirs); err == nil {
+		fmt.Printf("database: %s\n", cfg.DBPath)
+		fmt.Printf("music:    %s\n", cfg.MusicDir)
+	}
+}
@@ -1,17 +1,58 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"os"
 	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/stoneresearch/dimalimbo/internal/game"
-	"github.com/stoneresearch/dimalimbo/internal/settings"
+	"github.com/stoneresearch/dimalimbo/internal/paths"
 	"github.com/stoneresearch/dimalimbo/internal/storage"
 )
 
 func main() {
-	cfg := settings.Load("settings.json")
+	opts, err := parseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("dimalimbo: %v", err)
+	}
+	dirs := paths.Resolve(opts.portable)
+	if len(opts.args) > 0 {
+		switch opts.args[0] {
+		case "paths":
+			printPaths(dirs, opts)
+		case "audio":
+			if err := runAudio(opts.args[1:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+				log.Fatalf("dimalimbo: %v", err)
+			}
+		default:
+			log.Fatalf("dimalimbo: unknown command %q", opts.args[0])
+		}
+		return
+	}
+	if err := dirs.Ensure(); err != nil {
+		log.Printf("creating directories: %v", err)
+	}
+	moved, err := paths.Migrate(opts.legacyMoves(dirs))
+	for _, m := range moved {
+		log.Printf("moved %s", m)
+	}
+	if err != nil {
+		log.Printf("migrating files: %v", err)
+	}
+	cfg, warn, err := opts.settings(dirs)
+	if err != nil {
+		log.Fatalf("dimalimbo: %v", err)
+	}
+	if warn != nil {
+		log.Printf("settings: %v", warn)
+	}
 	store, err := storage.NewStorage(cfg.DBPath, time.Duration(cfg.CacheTTLSeconds)*time.Second)
 	if err != nil {
 		log.Fatalf("failed to initialize storage: %v", err)
@@ -19,6 +60,12 @@ func main() {
 
 	// Use the original game as base
 	g := game.New(store, cfg)
+	g.SetSeed(opts.seed)
+	if err := g.SetMode(opts.mode); err != nil {
+		log.Fatalf("dimalimbo: %v", err)
+	}
+	g.WatchSettings(opts.watchSettings(context.Background(), dirs))
+	g.SetProfileLoader(opts.loadProfile(dirs))
 
 	// Setup window - keep your original simple approach
 	ebiten.SetFullscreen(cfg.Fullscreen)
@@ -1,157 +1,189 @@
 package audio
 
 import (
-	"bytes"
 	"encoding/binary"
-	"math"
 	"time"
 
 	"github.com/hajimehoshi/ebiten/v2/audio"
-	"github.com/hajimehoshi/ebiten/v2/audio/wav"
 )
 
 type Manager struct {
 	ctx     *audio.Context
-	volume  float64
-	samples map[string][]byte
-	players map[string]*audio.Player
-	music   *audio.Player
-	muted   bool
+	mix     *mixer
+	out     *audio.Player // kept so the output stream is not collected
+	effects map[string]Effect
+	samples map[string][]int16 // rendered effects
+	stream  *musicStream
+	list    *playlist // the player's own music, used instead of stream
 	style   string
+	heardAt [2]int // epoch and step Steps reported last
 }
 
 func NewManager(sampleRate int, volume float64) *Manager {
-	return &Manager{
+	m := &Manager{
 		ctx:     audio.NewContext(sampleRate),
-		volume:  volume,
-		samples: make(map[string][]byte),
-		players: make(map[string]*audio.Player),
+		mix:     newMixer(sampleRate),
+		effects: defaultEffects,
+		samples: make(map[string][]int16),
+		heardAt: [2]int{-1, 0},
 	}
+	m.mix.setVolume(Master, volume)
+	if p, err := m.ctx.NewPlayer(m.mix); err == nil {
+		p.SetBufferSize(60 * time.Millisecond)
+		p.Play()
+		m.out = p
+	}
+	return m
 }
 
-func (m *Manager) SetVolume(v float64) { m.volume = v }
-func (m *Manager) ToggleMute() {
-	m.muted = !m.muted
-	if m.music != nil {
-		if m.muted {
-			m.music.Pause()
-		} else {
-			m.music.Play()
-		}
+// SetVolume sets the master volume.
+func (m *Manager) SetVolume(v float64) { m.SetBusVolume(Master, v) }
+
+// SetBusVolume sets a bus's volume, 0-1. Changes ramp in over a few
+// milliseconds, including for sounds already playing.
+func (m *Manager) SetBusVolume(b Bus, v float64) {
+	if m == nil || m.mix == nil {
+		return
 	}
+	m.mix.setVolume(b, v)
 }
-func (m *Manager) SetStyle(style string) { m.style = style }
 
-// generateSineWAV returns a minimal PCM 16-bit mono WAV.
-func generateSineWAV(sampleRate int, freq float64, dur time.Duration, vol float64) []byte {
-	frames := int(float64(sampleRate) * dur.Seconds())
-	pcm := make([]int16, frames)
-	for i := 0; i < frames; i++ {
-		v := math.Sin(2*math.Pi*freq*float64(i)/float64(sampleRate)) * vol
-		pcm[i] = int16(v * 32767)
-	}
-	data := make([]byte, len(pcm)*2)
-	for i, s := range pcm {
-		binary.LittleEndian.PutUint16(data[i*2:], uint16(s))
-	}
-	// WAV header
-	buf := &bytes.Buffer{}
-	// RIFF header
-	buf.WriteString("RIFF")
-	binary.Write(buf, binary.LittleEndian, uint32(36+len(data)))
-	buf.WriteString("WAVE")
-	// fmt chunk
-	buf.WriteString("fmt ")
-	binary.Write(buf, binary.LittleEndian, uint32(16))         // Subchunk1Size
-	binary.Write(buf, binary.LittleEndian, uint16(1))          // AudioFormat PCM
-	binary.Write(buf, binary.LittleEndian, uint16(1))          // NumChannels
-	binary.Write(buf, binary.LittleEndian, uint32(sampleRate)) // SampleRate
-	byteRate := uint32(sampleRate * 1 * 16 / 8)
-	binary.Write(buf, binary.LittleEndian, byteRate) // ByteRate
-	blockAlign := uint16(1 * 16 / 8)
-	binary.Write(buf, binary.LittleEndian, blockAlign) // BlockAlign
-	binary.Write(buf, binary.LittleEndian, uint16(16)) // BitsPerSample
-	// data chunk
-	buf.WriteString("data")
-	binary.Write(buf, binary.LittleEndian, uint32(len(data)))
-	buf.Write(data)
-	return buf.Bytes()
+// SetBusMuted mutes or unmutes a bus; muting Master silences everything.
+func (m *Manager) SetBusMuted(b Bus, muted bool) {
+	if m == nil || m.mix == nil {
+		return
+	}
+	m.mix.setMuted(b, muted)
 }
 
-func (m *Manager) ensurePlayer(key string, wavData []byte) (*audio.Player, error) {
-	if p, ok := m.players[key]; ok {
-		return p, nil
+// SetStyle picks the music style; a loop that is already playing switches
+// over at its next bar line.
+func (m *Manager) SetStyle(style string) {
+	if style == m.style {
+		return
 	}
-	r, err := wav.DecodeWithSampleRate(m.ctx.SampleRate(), bytes.NewReader(wavData))
-	if err != nil {
-		return nil, err
+	m.style = style
+	if m.stream == nil {
+		return
+	}
+	if st := m.loadStems(); st != nil {
+		m.stream.queue(st)
+	}
+}
+
+// SetIntensity sets how busy the music is, from 0 (pad only) through bass
+// and drums to 1 (everything including the lead).
+func (m *Manager) SetIntensity(x float64) {
+	if m == nil || m.stream == nil {
+		return
+	}
+	m.stream.setIntensity(x)
+}
+
+// NearMiss sweeps a low-pass filter over the music.
+func (m *Manager) NearMiss() {
+	if m == nil || m.stream == nil {
+		return
 	}
-	p, err := m.ctx.NewPlayer(r)
+	m.stream.nearMiss()
+}
+
+// loadStems renders the current style, falling back to the chiptune loop.
+func (m *Manager) loadStems() *stems {
+	song, err := LoadSong(m.style)
 	if err != nil {
-		return nil, err
+		song, err = LoadSong("chiptune")
+		if err != nil {
+			return nil
+		}
+	}
+	return renderStems(song, m.ctx.SampleRate())
+}
+
+// SetEffectsFile loads sound effects from an effects file (see
+// LoadEffects) on top of the built-in ones; "" restores the built-ins.
+// Effects that fail to parse are skipped and reported.
+func (m *Manager) SetEffectsFile(path string) error {
+	effects := make(map[string]Effect, len(defaultEffects))
+	for name, e := range defaultEffects {
+		effects[name] = e
 	}
-	m.players[key] = p
-	return p, nil
+	var err error
+	if path != "" {
+		var loaded map[string]Effect
+		loaded, err = LoadEffects(path)
+		for name, e := range loaded {
+			effects[name] = e
+		}
+	}
+	m.effects = effects
+	clear(m.samples)
+	return err
 }
 
-func (m *Manager) PlayStart()  { m.playTone("start", 420, 90*time.Millisecond) }
-func (m *Manager) PlayHit()    { m.playTone("hit", 110, 120*time.Millisecond) }
-func (m *Manager) PlaySubmit() { m.playTone("submit", 660, 80*time.Millisecond) }
+// Play plays the named sound effect, if there is one.
+func (m *Manager) Play(name string) {
+	if v := m.voice(name); v != nil {
+		m.mix.play(v)
+	}
+}
 
-func (m *Manager) playTone(key string, freq float64, dur time.Duration) {
-	if m == nil || m.ctx == nil {
+// PlayAt plays the named sound effect at src, panned and attenuated by its
+// distance from the listener as it moves.
+func (m *Manager) PlayAt(name string, src Source) {
+	if v := m.voice(name); v != nil {
+		v.src, v.placed = src, true
+		m.mix.play(v)
+	}
+}
+
+// SetListener moves the listener that placed sounds are heard from,
+// normally the player.
+func (m *Manager) SetListener(x, y float64) {
+	if m == nil || m.mix == nil {
+		return
+	}
+	m.mix.setListener(x, y)
+}
+
+// SetReverb sets the level of the shared reverb, 0 (dry) to 1.
+func (m *Manager) SetReverb(v float64) {
+	if m == nil || m.mix == nil {
 		return
 	}
-	w, ok := m.samples[key]
+	m.mix.setReverb(v)
+}
+
+// voice prepares the named sound effect for the mixer, rendering it the
+// first time it plays.
+func (m *Manager) voice(name string) *voice {
+	if m == nil || m.ctx == nil {
+		return nil
+	}
+	e, ok := m.effects[name]
 	if !ok {
-		w = generateSineWAV(m.ctx.SampleRate(), freq, dur, m.volume)
-		m.samples[key] = w
+		return nil
 	}
-	p, err := m.ensurePlayer(key, w)
-	if err != nil {
-		return
+	pcm, ok := m.samples[name]
+	if !ok {
+		pcm = e.Render(m.ctx.SampleRate())
+		m.samples[name] = pcm
 	}
-	_ = p.Rewind()
-	p.SetVolume(m.volume)
-	p.Play()
+	return &voice{pcm: pcm, bus: e.bus(), duck: e.Duck, send: e.Reverb}
 }
 
-// ==== Chiptune-style background music (loop) ====
+func (m *Manager) PlayStart()  { m.Play("start") }
+func (m *Manager) PlaySubmit() { m.Play("submit") }
 
-// squarePCM generates raw PCM16 mono bytes for a square wave with optional ADSR envelope.
-func squarePCM(sampleRate int, freq float64, dur time.Duration, vol float64, attackMs, decayMs, sustainLevel, releaseMs float64) []int16 {
-	frames := int(float64(sampleRate) * dur.Seconds())
-	pcm := make([]int16, frames)
-	a := int(attackMs * float64(sampleRate) / 1000)
-	d := int(decayMs * float64(sampleRate) / 1000)
-	r := int(releaseMs * float64(sampleRate) / 1000)
-	for i := 0; i < frames; i++ {
-		// Basic square (50% duty)
-		phase := math.Sin(2 * math.Pi * freq * float64(i) / float64(sampleRate))
-		s := 1.0
-		if phase < 0 {
-			s = -1.0
-		}
-		// Envelope
-		env := 1.0
-		if i < a && a > 0 {
-			env = float64(i) / float64(a)
-		} else if i < a+d && d > 0 {
-			t := float64(i-a) / float64(d)
-			env = 1.0 + t*(sustainLevel-1.0)
-		} else if i > frames-r && r > 0 {
-			t := float64(frames-i) / float64(r)
-			env = sustainLevel * t
-		} else {
-			env = sustainLevel
-		}
-		v := s * vol * env
-		pcm[i] = int16(v * 32767)
+// PlayHit plays the hit sound and the music's death stinger.
+func (m *Manager) PlayHit() {
+	m.Play("hit")
+	if m != nil && m.list == nil && m.stream != nil && m.musicPlaying() {
+		m.stream.playStinger()
 	}
-	return pcm
 }
 
-// mixTracks mixes multiple PCM16 mono tracks, preventing clipping.
+// mixTracks mixes PCM16 tracks of the same layout, soft-clipping peaks.
 func mixTracks(tracks ...[]int16) []byte {
 	maxLen := 0
 	for _, t := range tracks {
@@ -161,218 +193,135 @@ func mixTracks(tracks ...[]int16) []byte {
 	}
 	out := make([]byte, maxLen*2)
 	for i := 0; i < maxLen; i++ {
-		sum := 0
+		sum := 0.0
 		for _, t := range tracks {
 			if i < len(t) {
-				sum += int(t[i])
+				sum += float64(t[i])
 			}
 		}
-		// soft clip
-		if sum > 32767 {
-			sum = 32767
-		}
-		if sum < -32768 {
-			sum = -32768
-		}
-		binary.LittleEndian.PutUint16(out[i*2:], uint16(int16(sum)))
+		binary.LittleEndian.PutUint16(out[i*2:], uint16(clip16(sum)))
 	}
 	return out
 }
 
-// composeLoop builds a short melody + bass loop reminiscent of retro consoles.
-func composeLoop(sampleRate int) (pcm []byte) {
-	tempo := 132.0
-	beats := 16 // 4 bars of 4/4
-	beatDur := time.Duration(float64(time.Second) * 60.0 / tempo)
-	totalDur := beatDur * time.Duration(beats)
-	totalSamples := int(float64(sampleRate) * totalDur.Seconds())
-
-	// Lead notes (Hz) in a simple arpeggio pattern
-	scale := []float64{261.63, 329.63, 392.00, 523.25} // C E G C
-	lead := make([]int16, totalSamples)
-	idx := 0
-	halfBeatSamples := int(float64(sampleRate) * (beatDur.Seconds() / 2))
-	for b := 0; b < beats; b++ {
-		f := scale[b%len(scale)]
-		note := squarePCM(sampleRate, f, beatDur/2, 0.18, 4, 30, 0.6, 40)
-		for i := 0; i < len(note) && idx < len(lead); i++ {
-			lead[idx] = note[i]
-			idx++
-		}
-		// small rest
-		idx += halfBeatSamples
-		if idx > len(lead) {
-			idx = len(lead)
-		}
+// PlayMusic starts (or restarts) the looping background music.
+func (m *Manager) PlayMusic() {
+	if m == nil || m.ctx == nil {
+		return
 	}
-
-	// Bass on downbeats
-	bass := make([]int16, len(lead))
-	idx = 0
-	beatSamples := int(float64(sampleRate) * beatDur.Seconds())
-	for b := 0; b < beats; b++ {
-		if b%2 == 0 {
-			f := 130.81 // C3
-			note := squarePCM(sampleRate, f, beatDur, 0.15, 2, 40, 0.5, 60)
-			for i := 0; i < len(note) && idx < len(bass); i++ {
-				bass[idx] = note[i]
-				idx++
-			}
-		}
-		idx += beatSamples
-		if idx > len(bass) {
-			idx = len(bass)
-		}
+	if m.list != nil {
+		m.mix.setMusicOn(true)
+		return
 	}
-
-	pcm = mixTracks(lead, bass)
-	return
-}
-
-// ==== Synthwave generator ====
-// composeSynthwave creates a richer loop with pads, bass, and a noise snare.
-func composeSynthwave(sampleRate int) (pcm []byte) {
-	tempo := 96.0
-	beats := 16
-	beatDur := time.Duration(float64(time.Second) * 60.0 / tempo)
-	totalDur := beatDur * time.Duration(beats)
-	totalSamples := int(float64(sampleRate) * totalDur.Seconds())
-
-	// Pad (detuned saw approximated by averaging two squares)
-	pad := make([]int16, totalSamples)
-	for i := 0; i < totalSamples; i++ {
-		t := float64(i) / float64(sampleRate)
-		f1 := 220.0
-		f2 := 222.0
-		v := !math.Signbit(math.Sin(2 * math.Pi * f1 * t))
-		w := !math.Signbit(math.Sin(2 * math.Pi * f2 * t))
-		s := 0.0
-		if v {
-			s += 1
-		} else {
-			s -= 1
-		}
-		if w {
-			s += 1
-		} else {
-			s -= 1
+	if m.stream != nil {
+		if m.musicPlaying() {
+			return
 		}
-		pad[i] = int16(s * 0.09 * 32767)
+		m.stream.restart()
+		m.mix.setMusicOn(true)
+		return
 	}
-
-	// Bass 4-on-the-floor
-	bass := make([]int16, totalSamples)
-	beatSamples := int(float64(sampleRate) * beatDur.Seconds())
-	idx := 0
-	for b := 0; b < beats; b++ {
-		f := 110.0 // A2
-		note := squarePCM(sampleRate, f, beatDur, 0.20, 2, 40, 0.6, 40)
-		for i := 0; i < len(note) && idx < len(bass); i++ {
-			bass[idx] = note[i]
-			idx++
-		}
+	st := m.loadStems()
+	if st == nil {
+		return
 	}
+	m.stream = newMusicStream(m.ctx.SampleRate(), st)
+	m.mix.setMusic(m.stream)
+	m.mix.setMusicOn(true)
+}
 
-	// Lead arpeggio
-	lead := make([]int16, totalSamples)
-	scale := []float64{440.0, 554.37, 659.25, 880.0}
-	idx = 0
-	half := beatSamples / 2
-	for b := 0; b < beats; b++ {
-		f := scale[b%len(scale)]
-		note := squarePCM(sampleRate, f, beatDur/2, 0.17, 3, 30, 0.6, 40)
-		for i := 0; i < len(note) && idx < len(lead); i++ {
-			lead[idx] = note[i]
-			idx++
-		}
-		idx += half
-		if idx > len(lead) {
-			idx = len(lead)
-		}
+// SetPlaylist plays the player's own music files instead of the generated
+// songs, or goes back to the songs if p is nil. If the folder holds no
+// playable files the songs carry on and an error is returned.
+func (m *Manager) SetPlaylist(p *Playlist) error {
+	if m == nil || m.ctx == nil {
+		return nil
 	}
-
-	// Noise snare on 2 and 4 & hi-hat 8th notes
-	snare := make([]int16, totalSamples)
-	hihat := make([]int16, totalSamples)
-	rng := uint32(1)
-	noise := func() float64 { // simple LCG noise
-		rng = rng*1664525 + 1013904223
-		return float64(int32(rng>>16)) / 32768.0
-	}
-	for b := 0; b < beats; b++ {
-		if b%4 == 1 || b%4 == 3 { // 2 and 4
-			start := b * beatSamples
-			length := beatSamples / 3
-			for i := 0; i < length && start+i < totalSamples; i++ {
-				env := math.Exp(-3.5 * float64(i) / float64(length))
-				snare[start+i] = int16(noise() * 0.12 * env * 32767)
-			}
+	if p == nil {
+		if m.list == nil {
+			return nil
 		}
-		// hi-hat on 8ths
-		for h := 0; h < 2; h++ {
-			start := b*beatSamples + h*(beatSamples/2)
-			length := beatSamples / 8
-			for i := 0; i < length && start+i < totalSamples; i++ {
-				env := math.Exp(-6.0 * float64(i) / float64(length))
-				hihat[start+i] = int16(noise() * 0.06 * env * 32767)
+		m.list = nil
+		if m.stream == nil {
+			st := m.loadStems()
+			if st == nil {
+				return nil
 			}
+			m.stream = newMusicStream(m.ctx.SampleRate(), st)
 		}
+		m.mix.setMusic(m.stream)
+		return nil
 	}
-
-	// Kick on quarter notes using a low sine drop
-	kick := make([]int16, totalSamples)
-	for b := 0; b < beats; b++ {
-		start := b * beatSamples
-		length := beatSamples / 6
-		for i := 0; i < length && start+i < totalSamples; i++ {
-			t := float64(i) / float64(sampleRate)
-			f := 90.0 - 60.0*(float64(i)/float64(length))
-			s := math.Sin(2 * math.Pi * f * t)
-			env := math.Exp(-8.0 * float64(i) / float64(length))
-			kick[start+i] = int16(s * 0.22 * env * 32767)
-		}
+	tracks, err := p.Tracks()
+	if err != nil {
+		return err
 	}
-
-	pcm = mixTracks(pad, bass, lead, snare, hihat, kick)
-	return
+	m.list = newPlaylist(m.ctx.SampleRate(), *p, tracks)
+	m.mix.setMusic(m.list)
+	return nil
 }
 
-// PlayMusic starts (or restarts) a looping background melody.
-func (m *Manager) PlayMusic() {
-	if m == nil || m.ctx == nil {
+// NextTrack skips to the next track of the playlist, if one is in use.
+func (m *Manager) NextTrack() {
+	if m == nil || m.list == nil {
 		return
 	}
-	if m.muted {
-		return
+	m.list.next()
+}
+
+// Position reports where in the generated music the player is, allowing
+// for the audio still buffered on its way to the speakers. It is false
+// while no generated music plays, including when a playlist is in use.
+func (m *Manager) Position() (Position, bool) {
+	st, step, _, ok := m.heard()
+	if !ok {
+		return Position{}, false
 	}
-	if m.music != nil {
-		if m.music.IsPlaying() {
-			return
-		}
-		_ = m.music.Rewind()
-		m.music.SetVolume(m.volume * 0.8)
-		m.music.Play()
-		return
+	return st.position(step), true
+}
+
+// Steps returns the steps of the generated music heard since the last
+// call, oldest first, with the notes that start on each. After a song
+// change or restart only the current step is returned.
+func (m *Manager) Steps() []Step {
+	st, step, epoch, ok := m.heard()
+	if !ok {
+		m.heardAt[0] = -1
+		return nil
 	}
-	var pcm []byte
-	if m.style == "synthwave" {
-		pcm = composeSynthwave(m.ctx.SampleRate())
-	} else {
-		pcm = composeLoop(m.ctx.SampleRate())
+	steps := st.steps(m.heardAt[1], step, epoch != m.heardAt[0])
+	m.heardAt = [2]int{epoch, step}
+	return steps
+}
+
+// heard returns the stems and step of the generated music the player
+// hears, and the stream's epoch (see musicStream.heard).
+func (m *Manager) heard() (*stems, int, int, bool) {
+	if m == nil || m.stream == nil || m.list != nil || !m.musicPlaying() {
+		return nil, 0, 0, false
 	}
-	loop := audio.NewInfiniteLoop(bytes.NewReader(pcm), int64(len(pcm)))
-	p, err := m.ctx.NewPlayer(loop)
-	if err != nil {
-		return
+	lag := 0
+	if m.out != nil {
+		m.mix.mu.Lock()
+		read := m.mix.read
+		m.mix.mu.Unlock()
+		played := int64(m.out.Position().Seconds() * float64(m.ctx.SampleRate()))
+		lag = int(max(0, read-played))
 	}
-	m.music = p
-	m.music.SetVolume(m.volume * 0.4)
-	m.music.Play()
+	st, step, epoch := m.stream.heard(lag)
+	return st, step, epoch, true
 }
 
+// StopMusic fades the music out.
 func (m *Manager) StopMusic() {
-	if m == nil || m.music == nil {
+	if m == nil || m.mix == nil {
 		return
 	}
-	m.music.Pause()
+	m.mix.setMusicOn(false)
+}
+
+func (m *Manager) musicPlaying() bool {
+	m.mix.mu.Lock()
+	defer m.mix.mu.Unlock()
+	return m.mix.musicOn
 }
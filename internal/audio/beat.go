@@ -0,0 +1,95 @@
+package audio
+
+// Position is a point in the generated music: Bar counts from the start of
+// the song's loop, Beat from the start of the bar and Tick, in sequencer
+// steps, from the start of the beat.
+type Position struct {
+	Bar, Beat, Tick int
+	Step            int // step within the loop
+	BeatsPerBar     int
+	Tempo           float64 // beats per minute
+}
+
+// Onset is a note of the generated music starting at a step.
+type Onset struct {
+	Layer string  // one of Layers
+	Freq  float64 // Hz
+	Len   int     // in steps
+}
+
+// Step is a step of the music the player has heard and the notes that
+// start on it.
+type Step struct {
+	Position
+	Notes []Onset
+}
+
+// onsets lists the notes starting at each step of s's loop, leaving out
+// the stinger.
+func onsets(s *Song) [][]Onset {
+	out := make([][]Onset, s.Length)
+	for _, ch := range s.Channels {
+		if ch.Layer == stinger {
+			continue
+		}
+		for _, n := range ch.Notes {
+			if n.Step >= 0 && n.Step < s.Length {
+				out[n.Step] = append(out[n.Step], Onset{Layer: ch.Layer, Freq: n.Freq, Len: n.Len})
+			}
+		}
+	}
+	return out
+}
+
+// stepAt is the step of the loop playing at frame pos.
+func (st *stems) stepAt(pos, sampleRate int) int {
+	s := st.song
+	step := int(float64(pos) * s.Tempo * float64(s.StepsPerBeat) / (60 * float64(sampleRate)))
+	return max(0, min(s.Length-1, step))
+}
+
+// position is where step falls in the bars and beats of st.
+func (st *stems) position(step int) Position {
+	s := st.song
+	beat := step / s.StepsPerBeat
+	return Position{
+		Bar:         beat / s.BeatsPerBar,
+		Beat:        beat % s.BeatsPerBar,
+		Tick:        step % s.StepsPerBeat,
+		Step:        step,
+		BeatsPerBar: s.BeatsPerBar,
+		Tempo:       s.Tempo,
+	}
+}
+
+// heard returns the stems and step being heard when the last lag frames
+// filled are still on their way to the speakers, and an epoch that
+// changes whenever the stream jumps to a new song or back to the start.
+func (m *musicStream) heard(lag int) (*stems, int, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.cur.layers[0]) / 2
+	pos := ((m.pos-min(lag, m.since))%n + n) % n
+	return m.cur, m.cur.stepAt(pos, m.sampleRate), m.epoch
+}
+
+// steps lists the steps of st after last up to and including step, with
+// their notes. If the stream jumped (fresh) only step itself is listed,
+// as it is when more than a beat went by unseen.
+func (st *stems) steps(last, step int, fresh bool) []Step {
+	n := st.song.Length
+	first := step
+	if ahead := (step - last + n) % n; !fresh && ahead <= st.song.StepsPerBeat {
+		first = (last + 1) % n
+		if ahead == 0 {
+			return nil
+		}
+	}
+	var out []Step
+	for i := first; ; i = (i + 1) % n {
+		out = append(out, Step{Position: st.position(i), Notes: st.onsets[i]})
+		if i == step {
+			return out
+		}
+	}
+}
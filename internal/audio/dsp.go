@@ -0,0 +1,76 @@
+package audio
+
+import "math"
+
+const (
+	fullScale      = 32767.0
+	clipKnee       = 0.8 * fullScale // soft clipping starts here
+	limitThreshold = 0.9 * fullScale // the limiter holds peaks to this
+	limitRelease   = 0.1             // seconds for the limiter to recover
+	dcCutoff       = 20.0            // Hz below which the DC blocker cuts
+	minRamp        = 0.002           // seconds of the shortest fade in or out
+)
+
+// polyBLEP is the correction that band-limits a step at phase 0 of a wave
+// whose phase advances by inc per sample.
+func polyBLEP(phase, inc float64) float64 {
+	switch {
+	case phase < inc:
+		t := phase / inc
+		return t + t - t*t - 1
+	case phase > 1-inc:
+		t := (phase - 1) / inc
+		return t*t + t + t + 1
+	}
+	return 0
+}
+
+// softClip passes samples below the knee unchanged and bends louder ones
+// smoothly towards full scale, never past it.
+func softClip(x float64) float64 {
+	a := math.Abs(x)
+	if a <= clipKnee {
+		return x
+	}
+	return math.Copysign(clipKnee+(fullScale-clipKnee)*math.Tanh((a-clipKnee)/(fullScale-clipKnee)), x)
+}
+
+// clip16 soft-clips a sample into 16 bits.
+func clip16(x float64) int16 { return int16(softClip(x)) }
+
+// dcBlocker is a one-pole high-pass that removes any offset from a signal,
+// such as the one a square wave with an uneven duty cycle carries.
+type dcBlocker struct {
+	x1, y1 float64
+}
+
+// dcPole is the pole of a DC blocker at sampleRate.
+func dcPole(sampleRate int) float64 {
+	return 1 - 2*math.Pi*dcCutoff/float64(sampleRate)
+}
+
+func (d *dcBlocker) process(x, pole float64) float64 {
+	y := x - d.x1 + pole*d.y1
+	d.x1, d.y1 = x, y
+	return y
+}
+
+// limiter keeps a stereo bus out of clipping. It turns the gain down at
+// once when a peak would pass the threshold, lets it recover over
+// limitRelease, and soft-clips whatever gets through.
+type limiter struct {
+	gain float64
+}
+
+// process limits one frame; release is the per-sample recovery.
+func (l *limiter) process(left, right, release float64) (float64, float64) {
+	if l.gain == 0 {
+		l.gain = 1
+	}
+	if peak := max(math.Abs(left), math.Abs(right)); peak*l.gain > limitThreshold {
+		l.gain = limitThreshold / peak
+	} else {
+		l.gain += (1 - l.gain) * release
+	}
+	return softClip(left * l.gain), softClip(right * l.gain)
+}
@@ -0,0 +1,365 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// A Standard MIDI File becomes a Song: each MIDI channel turns into a
+// channel of the song played by the built-in voice of its General MIDI
+// program family, and channel 10 plays the drum kit on the kick, snare and
+// hi-hat generators.
+
+const (
+	midiStepsPerBeat = 12     // sixteenths and triplets both land on a step
+	midiTempo        = 500000 // µs per beat until a file sets one (120 BPM)
+	drumChannel      = 9      // channel 10, counting from 1
+)
+
+// Voices for the General MIDI program families.
+var (
+	midiPluck   = Instrument{Wave: "square", Volume: 0.14, Envelope: Envelope{Attack: 2, Decay: 250, Sustain: 0.3, Release: 60}, Effects: Effects{Duty: 0.25}}
+	midiBell    = Instrument{Wave: "sine", Volume: 0.18, Envelope: Envelope{Attack: 1, Decay: 400, Release: 100}}
+	midiOrgan   = Instrument{Wave: "square", Volume: 0.1, Envelope: Envelope{Attack: 5, Sustain: 1, Release: 40}}
+	midiBass    = Instrument{Wave: "square", Volume: 0.2, Envelope: Envelope{Attack: 2, Decay: 40, Sustain: 0.6, Release: 40}}
+	midiStrings = Instrument{Wave: "saw", Volume: 0.1, Envelope: Envelope{Attack: 120, Sustain: 1, Release: 200}, Effects: Effects{Detune: 10, Width: 0.7}}
+	midiBrass   = Instrument{Wave: "saw", Volume: 0.12, Envelope: Envelope{Attack: 15, Decay: 60, Sustain: 0.7, Release: 60}}
+	midiReed    = Instrument{Wave: "square", Volume: 0.12, Envelope: Envelope{Attack: 10, Sustain: 1, Release: 50}, Effects: Effects{Duty: 0.35}}
+	midiPipe    = Instrument{Wave: "sine", Volume: 0.2, Envelope: Envelope{Attack: 20, Sustain: 1, Release: 80}, Effects: Effects{Vibrato: 0.1, VibratoHz: 5}}
+	midiLead    = Instrument{Wave: "square", Volume: 0.15, Envelope: Envelope{Attack: 3, Decay: 30, Sustain: 0.6, Release: 40}}
+	midiPad     = Instrument{Wave: "square", Volume: 0.12, Envelope: Envelope{Attack: 150, Sustain: 1, Release: 250}, Effects: Effects{Detune: 14, Width: 0.8}}
+)
+
+// gmFamilies are the voice and layer of each family of eight General MIDI
+// programs.
+var gmFamilies = [16]struct {
+	layer string
+	voice Instrument
+}{
+	{"lead", midiPluck},  // piano
+	{"lead", midiBell},   // chromatic percussion
+	{"pad", midiOrgan},   // organ
+	{"lead", midiPluck},  // guitar
+	{"bass", midiBass},   // bass
+	{"pad", midiStrings}, // strings
+	{"pad", midiStrings}, // ensemble
+	{"lead", midiBrass},  // brass
+	{"lead", midiReed},   // reed
+	{"lead", midiPipe},   // pipe
+	{"lead", midiLead},   // synth lead
+	{"pad", midiPad},     // synth pad
+	{"pad", midiPad},     // synth effects
+	{"lead", midiPluck},  // ethnic
+	{"lead", midiBell},   // percussive
+	{"lead", midiBell},   // sound effects
+}
+
+// Drum kit voices.
+var (
+	midiKick    = Instrument{Wave: "kick", Volume: 0.22, Envelope: Envelope{Decay: 100}}
+	midiSnare   = Instrument{Wave: "noise", Volume: 0.12, Envelope: Envelope{Decay: 200}}
+	midiHat     = Instrument{Wave: "noise", Volume: 0.06, Envelope: Envelope{Decay: 75}}
+	midiOpenHat = Instrument{Wave: "noise", Volume: 0.06, Envelope: Envelope{Decay: 250}}
+	midiCymbal  = Instrument{Wave: "noise", Volume: 0.07, Envelope: Envelope{Decay: 700}}
+)
+
+// gmDrum is the voice a General MIDI drum key plays on: kicks and toms on
+// the kick, at the key's pitch; snares and claps on the snare; everything
+// else on the hi-hats and cymbals.
+func gmDrum(key int) Instrument {
+	switch key {
+	case 35, 36, 41, 43, 45, 47, 48, 50:
+		return midiKick
+	case 37, 38, 39, 40:
+		return midiSnare
+	case 46:
+		return midiOpenHat
+	case 49, 51, 52, 53, 55, 57, 59:
+		return midiCymbal
+	default:
+		return midiHat
+	}
+}
+
+// midiFreq is the pitch in Hz of a MIDI key.
+func midiFreq(key int) float64 { return 440 * math.Pow(2, float64(key-69)/12) }
+
+type midiNote struct {
+	ch, key, vel int
+	on, off      int // ticks
+}
+
+type midiTempoChange struct {
+	tick, usPerBeat int
+}
+
+// midiFile is what a Standard MIDI File says about its notes and timing.
+type midiFile struct {
+	division    int // ticks per beat
+	tempos      []midiTempoChange
+	beatsPerBar int
+	programs    [16]int // the first program change on each channel
+	notes       []midiNote
+	end         int // tick of the last end of track
+}
+
+// ParseMIDI compiles a Standard MIDI File (format 0 or 1) into a song. A
+// channel plays the voice of its first program change for the whole song;
+// velocity scales each note's volume.
+func ParseMIDI(b []byte) (*Song, error) {
+	f, err := readMIDI(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.notes) == 0 {
+		return nil, errors.New("song has no notes")
+	}
+	base, stepOf := f.stepper()
+	tempo := math.Round(60e6/float64(base)*100) / 100 // files store µs per beat, so 112 BPM is 112.00006
+	s := &Song{Tempo: tempo, BeatsPerBar: f.beatsPerBar, StepsPerBeat: midiStepsPerBeat}
+	stepsPerMs := s.Tempo * midiStepsPerBeat / 60000
+	bar := s.BeatsPerBar * s.StepsPerBeat
+	// checked before any tick becomes a step, which could overflow
+	if ms := f.micros(f.end)/1000 + float64(bar)/stepsPerMs; ms > maxSongMinutes*60000 {
+		return nil, fmt.Errorf("song lasts %.0f minutes; the limit is %d", ms/60000, maxSongMinutes)
+	}
+
+	sort.SliceStable(f.notes, func(i, j int) bool { return f.notes[i].ch < f.notes[j].ch })
+	end := stepOf(f.end)
+	longest, pad := -1, false
+	for i := 0; i < len(f.notes); {
+		ch := f.notes[i].ch
+		c := Channel{Name: fmt.Sprintf("ch%d", ch+1), Layer: gmFamilies[f.programs[ch]/8].layer}
+		if ch == drumChannel {
+			c.Name, c.Layer = "drums", "drums"
+		}
+		for ; i < len(f.notes) && f.notes[i].ch == ch; i++ {
+			n := f.notes[i]
+			voice, freq := gmFamilies[f.programs[ch]/8].voice, midiFreq(n.key)
+			on := stepOf(n.on)
+			length := max(1, stepOf(n.off)-on)
+			if ch == drumChannel {
+				// a hit rings for its decay whenever its note ends
+				voice = gmDrum(n.key)
+				length = max(1, int(math.Ceil(voice.Decay*stepsPerMs)))
+			}
+			voice.Volume *= float64(n.vel) / 127
+			c.Notes = append(c.Notes, Note{Step: on, Len: length, Freq: freq, Voice: voice})
+		}
+		pad = pad || c.Layer == "pad"
+		if ch != drumChannel && (longest < 0 || len(c.Notes) > len(s.Channels[longest].Notes)) {
+			longest = len(s.Channels)
+		}
+		s.Channels = append(s.Channels, c)
+	}
+	// the pad layer is the one that always plays, so a song needs one
+	if !pad {
+		s.Channels[max(0, longest)].Layer = "pad"
+	}
+	s.Length = (end + bar - 1) / bar * bar
+	return s, nil
+}
+
+// stepper returns the song's tempo, in µs per beat, and a function that
+// converts ticks to steps at that tempo. The song plays at the file's
+// opening tempo throughout, so later tempo changes move the notes instead.
+func (f *midiFile) stepper() (int, func(tick int) int) {
+	sort.SliceStable(f.tempos, func(i, j int) bool { return f.tempos[i].tick < f.tempos[j].tick })
+	base := midiTempo
+	if len(f.tempos) > 0 && f.tempos[0].tick == 0 {
+		base = f.tempos[0].usPerBeat
+	}
+	usPerStep := float64(base) / midiStepsPerBeat
+	return base, func(tick int) int { return int(math.Round(f.micros(tick) / usPerStep)) }
+}
+
+// micros is the time of tick from the start of the file, in µs, following
+// its tempo changes; f.tempos must be sorted.
+func (f *midiFile) micros(tick int) float64 {
+	var us float64
+	from, tempo := 0, midiTempo
+	for _, t := range f.tempos {
+		if t.tick >= tick {
+			break
+		}
+		us += float64(t.tick-from) * float64(tempo) / float64(f.division)
+		from, tempo = t.tick, t.usPerBeat
+	}
+	return us + float64(tick-from)*float64(tempo)/float64(f.division)
+}
+
+// readMIDI parses the chunks of a Standard MIDI File.
+func readMIDI(b []byte) (*midiFile, error) {
+	r := &midiReader{b: b}
+	if string(r.next(4)) != "MThd" {
+		return nil, errors.New("not a MIDI file")
+	}
+	header := r.next(r.u32())
+	if r.err != nil || len(header) < 6 {
+		return nil, errors.New("bad MIDI header")
+	}
+	format := binary.BigEndian.Uint16(header)
+	tracks := int(binary.BigEndian.Uint16(header[2:]))
+	division := int(binary.BigEndian.Uint16(header[4:]))
+	switch {
+	case format > 1:
+		return nil, fmt.Errorf("MIDI format %d is not supported (want 0 or 1)", format)
+	case division&0x8000 != 0:
+		return nil, errors.New("SMPTE timing is not supported")
+	case division == 0:
+		return nil, errors.New("bad MIDI time division")
+	}
+	f := &midiFile{division: division, beatsPerBar: 4}
+	for i := range f.programs {
+		f.programs[i] = -1
+	}
+	for track := 1; track <= tracks && len(r.b) > 0; {
+		id, data := string(r.next(4)), r.next(r.u32())
+		if r.err != nil {
+			return nil, fmt.Errorf("track %d: %w", track, r.err)
+		}
+		if id != "MTrk" {
+			continue // other chunks may be skipped
+		}
+		if err := f.readTrack(data); err != nil {
+			return nil, fmt.Errorf("track %d: %w", track, err)
+		}
+		track++
+	}
+	for i, p := range f.programs {
+		f.programs[i] = max(0, p)
+	}
+	return f, nil
+}
+
+// readTrack reads the events of one track.
+func (f *midiFile) readTrack(data []byte) error {
+	r := &midiReader{b: data}
+	held := make(map[[2]int]int) // notes sounding, by channel and key
+	tick, status := 0, 0
+	for len(r.b) > 0 && r.err == nil {
+		tick += r.vlq()
+		c := r.u8()
+		var d1 int
+		switch {
+		case c == 0xff:
+			kind := r.u8()
+			f.meta(tick, kind, r.next(r.vlq()))
+			if kind == 0x2f {
+				r.b = nil
+			}
+			continue
+		case c == 0xf0 || c == 0xf7:
+			r.next(r.vlq()) // system exclusive
+			continue
+		case c >= 0xf0:
+			return fmt.Errorf("unexpected status %#x at tick %d", c, tick)
+		case c >= 0x80:
+			status, d1 = c, r.u8()&0x7f
+		case status == 0:
+			return fmt.Errorf("data byte without a status at tick %d", tick)
+		default: // running status
+			d1 = c
+		}
+		ch := status & 0x0f
+		switch status >> 4 {
+		case 0x8, 0x9:
+			key, vel := d1, r.u8()&0x7f
+			if i, ok := held[[2]int{ch, key}]; ok {
+				f.notes[i].off = tick
+				delete(held, [2]int{ch, key})
+			}
+			if status>>4 == 0x9 && vel > 0 {
+				held[[2]int{ch, key}] = len(f.notes)
+				f.notes = append(f.notes, midiNote{ch: ch, key: key, vel: vel, on: tick})
+			}
+		case 0xc:
+			if f.programs[ch] < 0 {
+				f.programs[ch] = d1
+			}
+		case 0xd:
+			// channel pressure has a single data byte
+		default:
+			r.u8()
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	// notes never released end with the track
+	for _, i := range held {
+		f.notes[i].off = tick
+	}
+	f.end = max(f.end, tick)
+	return nil
+}
+
+// meta takes the tempo and time signature from a meta event.
+func (f *midiFile) meta(tick, kind int, data []byte) {
+	switch {
+	case kind == 0x51 && len(data) == 3:
+		us := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+		if us > 0 {
+			f.tempos = append(f.tempos, midiTempoChange{tick, us})
+		}
+	case kind == 0x58 && len(data) >= 2 && data[1] <= 6 && tick == 0:
+		// beats are quarter notes, so 6/8 has three; the denominator is a
+		// power of two, up to 64ths
+		if n, d := int(data[0])*4, 1<<data[1]; n%d == 0 && n/d > 0 {
+			f.beatsPerBar = n / d
+		}
+	}
+}
+
+// midiReader reads big-endian fields and variable-length numbers from b,
+// keeping the first error.
+type midiReader struct {
+	b   []byte
+	err error
+}
+
+func (r *midiReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err, r.b = errors.New("unexpected end of data"), nil
+		return nil
+	}
+	out := r.b[:n]
+	r.b = r.b[n:]
+	return out
+}
+
+func (r *midiReader) u8() int {
+	if b := r.next(1); b != nil {
+		return int(b[0])
+	}
+	return 0
+}
+
+func (r *midiReader) u32() int {
+	if b := r.next(4); b != nil {
+		return int(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+// vlq reads a variable-length number of up to four bytes.
+func (r *midiReader) vlq() int {
+	v := 0
+	for i := 0; i < 4; i++ {
+		c := r.u8()
+		v = v<<7 | c&0x7f
+		if c&0x80 == 0 {
+			return v
+		}
+	}
+	if r.err == nil {
+		r.err = errors.New("bad variable-length number")
+	}
+	return 0
+}
@@ -0,0 +1,221 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// chunk builds a chunk of a Standard MIDI File.
+func chunk(id string, body []byte) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte(id), uint32(len(body))), body...)
+}
+
+// smf builds a Standard MIDI File of format from finished track chunks.
+func smf(format, division int, tracks ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint16(nil, uint16(format))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(tracks)))
+	header = binary.BigEndian.AppendUint16(header, uint16(division))
+	return append(chunk("MThd", header), bytes.Join(tracks, nil)...)
+}
+
+// mtrk builds a track chunk from events and ends it.
+func mtrk(events ...[]byte) []byte {
+	body := bytes.Join(events, nil)
+	return chunk("MTrk", append(body, 0, 0xff, 0x2f, 0))
+}
+
+// ev is an event delta ticks after the previous one.
+func ev(delta int, data ...byte) []byte {
+	b := []byte{byte(delta & 0x7f)}
+	for delta >>= 7; delta > 0; delta >>= 7 {
+		b = append([]byte{byte(delta&0x7f | 0x80)}, b...)
+	}
+	return append(b, data...)
+}
+
+// tempo is a set-tempo meta event of us µs per beat.
+func tempo(delta, us int) []byte {
+	return ev(delta, 0xff, 0x51, 3, byte(us>>16), byte(us>>8), byte(us))
+}
+
+// At 96 ticks per beat a step is 8 ticks.
+const division = 96
+
+func TestMIDIRunningStatus(t *testing.T) {
+	s, err := ParseMIDI(smf(0, division, mtrk(
+		ev(0, 0x90, 60, 100),
+		ev(96, 60, 0), // running status; velocity 0 ends the note
+		ev(0, 62, 80),
+		ev(48, 0x80, 62, 64),
+		ev(0, 0x90, 64, 127),
+		ev(96, 0x90, 64, 0),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Tempo != 120 || s.BeatsPerBar != 4 || s.StepsPerBeat != midiStepsPerBeat {
+		t.Errorf("tempo %v, %d beats per bar, %d steps per beat", s.Tempo, s.BeatsPerBar, s.StepsPerBeat)
+	}
+	if len(s.Channels) != 1 {
+		t.Fatalf("%d channels, want 1", len(s.Channels))
+	}
+	c := s.Channels[0]
+	// the only channel becomes the pad, which always plays
+	if c.Name != "ch1" || c.Layer != "pad" {
+		t.Errorf("channel %s on %s, want ch1 on pad", c.Name, c.Layer)
+	}
+	want := []struct{ step, len, key, vel int }{{0, 12, 60, 100}, {12, 6, 62, 80}, {18, 12, 64, 127}}
+	if len(c.Notes) != len(want) {
+		t.Fatalf("%d notes, want %d", len(c.Notes), len(want))
+	}
+	for i, w := range want {
+		n := c.Notes[i]
+		if n.Step != w.step || n.Len != w.len || n.Freq != midiFreq(w.key) || n.Voice.Volume != midiPluck.Volume*float64(w.vel)/127 {
+			t.Errorf("note %d = step %d len %d %.1f Hz volume %.3f, want step %d len %d key %d velocity %d",
+				i, n.Step, n.Len, n.Freq, n.Voice.Volume, w.step, w.len, w.key, w.vel)
+		}
+	}
+	// 30 steps round up to one bar
+	if s.Length != 48 {
+		t.Errorf("length %d, want 48", s.Length)
+	}
+}
+
+func TestMIDITempoChanges(t *testing.T) {
+	s, err := ParseMIDI(smf(0, division, mtrk(
+		tempo(0, 600000), // 100 BPM
+		ev(0, 0x90, 60, 100),
+		tempo(96, 300000), // twice as fast after a beat
+		ev(96, 0x80, 60, 0),
+		ev(0, 0x90, 62, 100),
+		ev(96, 0x80, 62, 0),
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Tempo != 100 {
+		t.Errorf("tempo %v, want the opening 100", s.Tempo)
+	}
+	// the song keeps the opening tempo, so the faster beats take half the steps
+	notes := s.Channels[0].Notes
+	if notes[0].Step != 0 || notes[0].Len != 18 || notes[1].Step != 18 || notes[1].Len != 6 {
+		t.Errorf("notes at %d+%d and %d+%d, want 0+18 and 18+6", notes[0].Step, notes[0].Len, notes[1].Step, notes[1].Len)
+	}
+}
+
+func TestMIDIFormat1(t *testing.T) {
+	s, err := ParseMIDI(smf(1, division,
+		mtrk( // conductor: 3/4 at 90 BPM
+			ev(0, 0xff, 0x58, 4, 3, 2, 24, 8),
+			tempo(0, 666667),
+		),
+		mtrk(
+			ev(0, 0xc0, 33), // fingered bass
+			ev(0, 0x90, 36, 100),
+			ev(96, 0x80, 36, 0),
+		),
+		mtrk(
+			ev(0, 0xc1, 48), // strings
+			ev(0, 0xc1, 0),  // later program changes are ignored
+			ev(0, 0x91, 60, 90),
+			ev(288, 0x81, 60, 0),
+			ev(0, 0x99, 38, 127), // snare
+			ev(96, 0x89, 38, 0),  // runs into the second bar
+		),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Tempo != 90 || s.BeatsPerBar != 3 {
+		t.Errorf("tempo %v with %d beats per bar, want 90 and 3", s.Tempo, s.BeatsPerBar)
+	}
+	var got []string
+	for _, c := range s.Channels {
+		got = append(got, c.Name+"/"+c.Layer)
+	}
+	if strings.Join(got, " ") != "ch1/bass ch2/pad drums/drums" {
+		t.Errorf("channels %v", got)
+	}
+	if v := s.Channels[1].Notes[0].Voice; v.Wave != midiStrings.Wave || v.Attack != midiStrings.Attack {
+		t.Errorf("ch2 plays %+v, want the strings", v)
+	}
+	if n := s.Channels[2].Notes[0]; n.Step != 36 || n.Voice.Wave != "noise" {
+		t.Errorf("snare at step %d on %s", n.Step, n.Voice.Wave)
+	}
+	if s.Length != 72 {
+		t.Errorf("length %d, want two bars of 36 steps", s.Length)
+	}
+}
+
+func TestMIDIBadInput(t *testing.T) {
+	notes := mtrk(ev(0, 0x90, 60, 100), ev(96, 0x80, 60, 0))
+	for _, tc := range []struct {
+		name string
+		file []byte
+		err  string
+	}{
+		{"empty", nil, "not a MIDI file"},
+		{"wrong magic", append([]byte("RIFF"), smf(0, division, notes)[4:]...), "not a MIDI file"},
+		{"short header", chunk("MThd", []byte{0, 0}), "bad MIDI header"},
+		{"format 2", smf(2, division, notes), "format 2"},
+		{"smpte", smf(0, 0xe728, notes), "SMPTE"},
+		{"no division", smf(0, 0, notes), "time division"},
+		{"truncated track", smf(0, division, notes)[:30], "unexpected end"},
+		{"no status", smf(0, division, mtrk(ev(0, 60, 100))), "without a status"},
+		{"no notes", smf(0, division, mtrk(tempo(0, 500000))), "no notes"},
+		{"too long", smf(0, 1, mtrk(ev(0, 0x90, 60, 100), ev(0x0fffffff, 0x80, 60, 0))), "limit"},
+		{"huge bar", smf(0, division, mtrk(ev(0, 0xff, 0x58, 2, 255, 0), ev(0, 0x90, 60, 100), ev(1, 0x80, 60, 0))), "limit"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseMIDI(tc.file)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("err = %v, want it to mention %q", err, tc.err)
+			}
+		})
+	}
+}
+
+// TestMIDIGarbage feeds the parser truncated and corrupted files, which
+// must fail or parse but never panic or run away.
+func TestMIDIGarbage(t *testing.T) {
+	file := smf(1, division,
+		mtrk(ev(0, 0xff, 0x58, 4, 6, 3, 24, 8), tempo(0, 400000)),
+		mtrk(ev(0, 0xc0, 40), ev(0, 0x90, 60, 100), ev(48, 62, 90), ev(48, 0x80, 60, 0), ev(0, 62, 0)),
+	)
+	if _, err := ParseMIDI(file); err != nil {
+		t.Fatal(err)
+	}
+	for n := range file {
+		ParseMIDI(file[:n])
+	}
+	rng := rand.New(rand.NewSource(1))
+	for range 2000 {
+		b := bytes.Clone(file)
+		for range 1 + rng.Intn(4) {
+			b[14+rng.Intn(len(b)-14)] = byte(rng.Intn(256))
+		}
+		if s, err := ParseMIDI(b); err == nil && s.Length > 1<<20 {
+			t.Fatalf("%x parsed to %d steps", b, s.Length)
+		}
+	}
+	// time signatures whose denominators do not fit an int shift
+	for _, denom := range []byte{7, 63, 64, 200} {
+		s, err := ParseMIDI(smf(0, division, mtrk(ev(0, 0xff, 0x58, 2, 4, denom), ev(0, 0x90, 60, 100), ev(96, 0x80, 60, 0))))
+		if err != nil || s.BeatsPerBar != 4 {
+			t.Errorf("denominator 2^%d: %v, %v", denom, s, err)
+		}
+	}
+}
+
+func TestBuiltinMIDI(t *testing.T) {
+	s, err := LoadSong("neon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Length == 0 || len(s.Channels) == 0 {
+		t.Errorf("neon has %d steps on %d channels", s.Length, len(s.Channels))
+	}
+}
@@ -0,0 +1,242 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+)
+
+// Bus is a mixer channel with its own volume and mute. Music, SFX and UI
+// feed Master.
+type Bus int
+
+const (
+	Master Bus = iota
+	Music
+	SFX
+	UI
+	numBuses
+)
+
+const (
+	rampTime    = 0.03 // seconds for volume and mute changes to settle
+	duckDepth   = 0.6  // fraction the music drops by under important sounds
+	duckAttack  = 0.01 // seconds
+	duckRelease = 0.35 // seconds
+	musicSend   = 0.25 // share of the music sent to the reverb
+)
+
+// source is music the mixer pulls from: the generated songs or a playlist.
+type source interface {
+	// fill renders the next len(out)/2 frames of interleaved stereo.
+	fill(out []float64)
+}
+
+// voice is a sound effect being played.
+type voice struct {
+	pcm    []int16 // mono
+	pos    int
+	bus    Bus
+	duck   bool    // music ducks while it plays
+	send   float64 // share sent to the reverb
+	src    Source  // where the sound is, if placed
+	placed bool
+}
+
+// mixer sums the music and sound effects into one 16-bit stereo stream,
+// ramping bus gains so changes never click. Placed sounds are panned and
+// attenuated relative to the listener, and everything can feed a shared
+// reverb that returns into the master bus.
+type mixer struct {
+	mu         sync.Mutex
+	sampleRate int
+	volume     [numBuses]float64
+	muted      [numBuses]bool
+	gain       [numBuses]float64 // current gains, ramping towards volume
+	duck       float64
+	music      source
+	prev       source // music being faded out after setMusic
+	swap       int    // frames left of that fade
+	musicOn    bool
+	voices     []*voice
+	scratch    []float64
+	prevBuf    []float64
+	listener   [2]float64
+	rev        *reverb
+	wet        float64 // reverb return level
+	wetGain    float64 // current return, ramping towards wet
+	dc         [2]dcBlocker
+	lim        limiter
+	read       int64 // frames handed to the output so far
+}
+
+func newMixer(sampleRate int) *mixer {
+	m := &mixer{sampleRate: sampleRate, rev: newReverb(sampleRate)}
+	for b := range m.volume {
+		m.volume[b] = 1
+		m.gain[b] = 1
+	}
+	m.gain[Music] = 0
+	return m
+}
+
+func (m *mixer) setVolume(b Bus, v float64) {
+	m.mu.Lock()
+	m.volume[b] = max(0, min(1, v))
+	m.mu.Unlock()
+}
+
+func (m *mixer) setMuted(b Bus, muted bool) {
+	m.mu.Lock()
+	m.muted[b] = muted
+	m.mu.Unlock()
+}
+
+func (m *mixer) setReverb(v float64) {
+	m.mu.Lock()
+	m.wet = max(0, min(1, v))
+	m.mu.Unlock()
+}
+
+func (m *mixer) setListener(x, y float64) {
+	m.mu.Lock()
+	m.listener = [2]float64{x, y}
+	m.mu.Unlock()
+}
+
+// setMusic changes the music source, fading briefly from the old one if it
+// is playing. A playlist that is replaced is closed once it is silent.
+func (m *mixer) setMusic(s source) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.music == s {
+		return
+	}
+	if m.prev != nil {
+		retire(m.prev)
+	}
+	m.prev, m.swap = nil, 0
+	if m.music != nil && m.gain[Music] > 1e-4 {
+		m.prev, m.swap = m.music, int(crossfade*float64(m.sampleRate))
+	} else if m.music != nil {
+		retire(m.music)
+	}
+	m.music = s
+}
+
+// retire closes a music source that will not play again.
+func retire(s source) {
+	if c, ok := s.(interface{ close() }); ok {
+		c.close()
+	}
+}
+
+func (m *mixer) setMusicOn(on bool) {
+	m.mu.Lock()
+	m.musicOn = on
+	m.mu.Unlock()
+}
+
+func (m *mixer) play(v *voice) {
+	m.mu.Lock()
+	m.voices = append(m.voices, v)
+	m.mu.Unlock()
+}
+
+// target is the gain bus b is ramping towards.
+func (m *mixer) target(b Bus) float64 {
+	if m.muted[b] || (b == Music && !m.musicOn) {
+		return 0
+	}
+	return m.volume[b]
+}
+
+func (m *mixer) Read(buf []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	frames := len(buf) / 4
+	m.read += int64(frames)
+	sr := float64(m.sampleRate)
+	ramp := 1 - math.Exp(-1/(rampTime*sr))
+	attack := 1 - math.Exp(-1/(duckAttack*sr))
+	release := 1 - math.Exp(-1/(duckRelease*sr))
+	limit := 1 - math.Exp(-1/(limitRelease*sr))
+	pole := dcPole(m.sampleRate)
+
+	if cap(m.scratch) < frames*2 {
+		m.scratch = make([]float64, frames*2)
+	}
+	if cap(m.prevBuf) < frames*2 {
+		m.prevBuf = make([]float64, frames*2)
+	}
+	music := m.scratch[:frames*2]
+	if m.music != nil && (m.musicOn || m.gain[Music] > 1e-4) {
+		m.music.fill(music)
+	} else {
+		clear(music)
+	}
+	if m.prev != nil {
+		prev := m.prevBuf[:frames*2]
+		m.prev.fill(prev)
+		fadeLen := crossfade * sr
+		for f := 0; f < frames && m.swap > 0; f++ {
+			x := float64(m.swap) / fadeLen
+			for c := 0; c < 2; c++ {
+				music[f*2+c] = music[f*2+c]*(1-x) + prev[f*2+c]*x
+			}
+			m.swap--
+		}
+		if m.swap == 0 {
+			retire(m.prev)
+			m.prev = nil
+		}
+	}
+	ducking := false
+	for _, v := range m.voices {
+		ducking = ducking || v.duck
+	}
+	for f := 0; f < frames; f++ {
+		for b := range m.gain {
+			m.gain[b] += (m.target(Bus(b)) - m.gain[b]) * ramp
+		}
+		if ducking {
+			m.duck += (duckDepth - m.duck) * attack
+		} else {
+			m.duck -= m.duck * release
+		}
+		m.wetGain += (m.wet - m.wetGain) * ramp
+		g := m.gain[Music] * (1 - m.duck)
+		l, r := music[f*2]*g, music[f*2+1]*g
+		send := (l + r) / 2 * musicSend
+		for _, v := range m.voices {
+			if v.pos >= len(v.pcm) {
+				continue
+			}
+			s := float64(v.pcm[v.pos]) * m.gain[v.bus]
+			gl, gr, vs := 1.0, 1.0, v.send
+			if v.placed {
+				var far float64
+				gl, gr, far = spatial(v.src, float64(v.pos)/sr, m.listener[0], m.listener[1])
+				vs += far
+			}
+			l, r = l+s*gl, r+s*gr
+			send += s * vs
+			v.pos++
+		}
+		wl, wr := m.rev.process(send)
+		l = m.dc[0].process((l+wl*m.wetGain)*m.gain[Master], pole)
+		r = m.dc[1].process((r+wr*m.wetGain)*m.gain[Master], pole)
+		l, r = m.lim.process(l, r, limit)
+		binary.LittleEndian.PutUint16(buf[f*4:], uint16(int16(l)))
+		binary.LittleEndian.PutUint16(buf[f*4+2:], uint16(int16(r)))
+	}
+	alive := m.voices[:0]
+	for _, v := range m.voices {
+		if v.pos < len(v.pcm) {
+			alive = append(alive, v)
+		}
+	}
+	clear(m.voices[len(alive):])
+	m.voices = alive
+	return frames * 4, nil
+}
@@ -0,0 +1,214 @@
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+)
+
+// Layers are the stems a song's channels are grouped into. Each fades in
+// once the music's intensity reaches its threshold in layerFrom.
+var Layers = []string{"pad", "bass", "drums", "lead"}
+
+var layerFrom = []float64{0, 0.2, 0.45, 0.7}
+
+// stinger is the layer of channels played once on death instead of looping.
+const stinger = "stinger"
+
+const (
+	layerFade   = 2.0   // seconds for a layer to fade fully in or out
+	sweepTime   = 0.6   // seconds for a near-miss filter sweep to open again
+	sweepCutoff = 500.0 // Hz at the bottom of the sweep
+	crossfade   = 0.05  // seconds of overlap when switching songs
+)
+
+func layerIndex(name string) int {
+	for i, l := range Layers {
+		if l == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// stems is a song rendered for live mixing, in interleaved stereo.
+type stems struct {
+	layers  [][]int16 // one loop per entry of Layers
+	stinger []int16
+	bar     int // frames per bar, where song changes may happen
+	song    *Song
+	onsets  [][]Onset // notes starting at each step of the loop
+}
+
+func renderStems(s *Song, sampleRate int) *stems {
+	st := &stems{layers: make([][]int16, len(Layers)), song: s, onsets: onsets(s)}
+	length := s.stepSample(s.Length, sampleRate)
+	for i := range st.layers {
+		st.layers[i] = make([]int16, length*2)
+	}
+	var stingers [][]int16
+	for i, ch := range s.Channels {
+		if ch.Layer == stinger {
+			end := 0
+			for _, n := range ch.Notes {
+				end = max(end, n.Step+n.Len)
+			}
+			stingers = append(stingers, s.renderChannel(sampleRate, i, end))
+			continue
+		}
+		layer := st.layers[layerIndex(ch.Layer)]
+		for j, v := range s.renderChannel(sampleRate, i, s.Length) {
+			layer[j] = clip16(float64(layer[j]) + float64(v))
+		}
+	}
+	if len(stingers) > 0 {
+		st.stinger = pcm16(mixTracks(stingers...))
+	}
+	st.bar = max(1, s.stepSample(s.BeatsPerBar*s.StepsPerBeat, sampleRate))
+	return st
+}
+
+// pcm16 decodes little-endian PCM16 bytes.
+func pcm16(b []byte) []int16 {
+	out := make([]int16, len(b)/2)
+	for i := range out {
+		out[i] = int16(binary.LittleEndian.Uint16(b[i*2:]))
+	}
+	return out
+}
+
+// musicStream plays stems as an endless stream whose layers, filter and
+// song follow the game while it plays. The mixer pulls samples from it.
+type musicStream struct {
+	mu         sync.Mutex
+	sampleRate int
+	cur        *stems
+	pos        int
+	next       *stems // switched to at the next bar line
+	old        *stems // fading out after a switch
+	oldPos     int
+	fade       int // samples of crossfade left
+	intensity  float64
+	gains      []float64
+	sweep      float64    // 1 right after a near miss, back to 0 when open
+	lp         [2]float64 // low-pass filter state, per side
+	sting      []int16
+	stingPos   int
+	since      int // frames played since pos last jumped
+	epoch      int // counts those jumps
+}
+
+func newMusicStream(sampleRate int, st *stems) *musicStream {
+	m := &musicStream{sampleRate: sampleRate, cur: st, gains: make([]float64, len(Layers))}
+	m.gains[0] = 1
+	return m
+}
+
+// setIntensity sets how many layers play, from 0 (pad only) to 1 (all).
+func (m *musicStream) setIntensity(x float64) {
+	m.mu.Lock()
+	m.intensity = max(0, min(1, x))
+	m.mu.Unlock()
+}
+
+// nearMiss closes the low-pass filter briefly.
+func (m *musicStream) nearMiss() {
+	m.mu.Lock()
+	m.sweep = 1
+	m.mu.Unlock()
+}
+
+// playStinger plays the song's stinger once over the loop.
+func (m *musicStream) playStinger() {
+	m.mu.Lock()
+	m.sting, m.stingPos = m.cur.stinger, 0
+	m.mu.Unlock()
+}
+
+// queue switches to st at the next bar line of the current song.
+func (m *musicStream) queue(st *stems) {
+	m.mu.Lock()
+	m.next = st
+	m.mu.Unlock()
+}
+
+// restart jumps back to the start of the loop.
+func (m *musicStream) restart() {
+	m.mu.Lock()
+	if m.next != nil {
+		m.cur, m.next = m.next, nil
+	}
+	m.pos, m.since, m.fade, m.sweep, m.sting = 0, 0, 0, 0, nil
+	m.epoch++
+	m.mu.Unlock()
+}
+
+// target is the level a layer fades towards at the current intensity.
+func (m *musicStream) target(layer int) float64 {
+	if layer == 0 {
+		return 1
+	}
+	return max(0, min(1, (m.intensity-layerFrom[layer])/0.15))
+}
+
+// layerSample mixes the layers of st at frame pos.
+func (m *musicStream) layerSample(st *stems, pos int) (left, right float64) {
+	for i, l := range st.layers {
+		left += float64(l[pos*2]) * m.gains[i]
+		right += float64(l[pos*2+1]) * m.gains[i]
+	}
+	return left, right
+}
+
+// fill renders the next len(out)/2 frames of interleaved stereo.
+func (m *musicStream) fill(out []float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sr := float64(m.sampleRate)
+	step := 1 / (layerFade * sr)
+	for f := 0; f < len(out)/2; f++ {
+		if m.next != nil && m.pos%m.cur.bar == 0 {
+			m.old, m.oldPos = m.cur, m.pos
+			m.cur, m.next, m.pos, m.since = m.next, nil, 0, 0
+			m.epoch++
+			m.fade = int(crossfade * sr)
+		}
+		for i := range m.gains {
+			t := m.target(i)
+			switch {
+			case m.gains[i] < t:
+				m.gains[i] = min(t, m.gains[i]+step)
+			case m.gains[i] > t:
+				m.gains[i] = max(t, m.gains[i]-step)
+			}
+		}
+		var v [2]float64
+		v[0], v[1] = m.layerSample(m.cur, m.pos)
+		if m.fade > 0 {
+			x := float64(m.fade) / (crossfade * sr)
+			l, r := m.layerSample(m.old, m.oldPos)
+			v[0], v[1] = v[0]*(1-x)+l*x, v[1]*(1-x)+r*x
+			m.oldPos = (m.oldPos + 1) % (len(m.old.layers[0]) / 2)
+			m.fade--
+		}
+		if m.sweep > 0 {
+			cutoff := 18000 * math.Pow(sweepCutoff/18000, m.sweep)
+			k := 1 - math.Exp(-2*math.Pi*cutoff/sr)
+			for c := range v {
+				m.lp[c] += (v[c] - m.lp[c]) * k
+				v[c] = m.lp[c]
+			}
+			m.sweep = max(0, m.sweep-1/(sweepTime*sr))
+		} else {
+			m.lp = v
+		}
+		if m.stingPos+1 < len(m.sting) {
+			v[0] += float64(m.sting[m.stingPos])
+			v[1] += float64(m.sting[m.stingPos+1])
+			m.stingPos += 2
+		}
+		out[f*2], out[f*2+1] = v[0], v[1]
+		m.pos = (m.pos + 1) % (len(m.cur.layers[0]) / 2)
+		m.since++
+	}
+}
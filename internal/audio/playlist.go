@@ -0,0 +1,411 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hajimehoshi/ebiten/v2/audio"
+	"github.com/hajimehoshi/ebiten/v2/audio/mp3"
+	"github.com/hajimehoshi/ebiten/v2/audio/vorbis"
+	"github.com/hajimehoshi/ebiten/v2/audio/wav"
+)
+
+// Playlist plays the player's own music files instead of the generated
+// songs.
+type Playlist struct {
+	Dir       string  // folder of .ogg, .mp3 and .wav files
+	Shuffle   bool    // play in a random order, reshuffled each time round
+	Repeat    string  // "all" (default), "one" or "off"
+	Crossfade float64 // seconds of overlap between tracks
+}
+
+var musicExts = map[string]bool{".ogg": true, ".mp3": true, ".wav": true}
+
+// Tracks lists the playable files in the playlist's folder, by name.
+func (p Playlist) Tracks() ([]string, error) {
+	entries, err := os.ReadDir(p.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var tracks []string
+	for _, e := range entries {
+		if !e.IsDir() && musicExts[strings.ToLower(filepath.Ext(e.Name()))] {
+			tracks = append(tracks, filepath.Join(p.Dir, e.Name()))
+		}
+	}
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("no .ogg, .mp3 or .wav files in %s", p.Dir)
+	}
+	sort.Strings(tracks)
+	return tracks, nil
+}
+
+// track is a decoded music file: 16-bit stereo at the output rate.
+type track struct {
+	f      *os.File
+	src    io.Reader
+	length int64 // bytes left to play; -1 loops forever
+}
+
+// openTrack decodes a music file. A looping track repeats its loop points
+// (see loopPoints) gaplessly for ever.
+func openTrack(path string, sampleRate int, loop bool) (*track, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var s interface {
+		io.ReadSeeker
+		Length() int64
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ogg":
+		s, err = vorbis.DecodeWithSampleRate(sampleRate, f)
+	case ".mp3":
+		s, err = mp3.DecodeWithSampleRate(sampleRate, f)
+	default:
+		s, err = wav.DecodeWithSampleRate(sampleRate, f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+	}
+	t := &track{f: f, src: s, length: s.Length()}
+	if loop {
+		start, end := loopPoints(path, sampleRate)
+		const frame = 4
+		start = min(start*frame, s.Length())
+		end = end * frame
+		if end <= start || end > s.Length() {
+			end = s.Length()
+		}
+		t.src = audio.NewInfiniteLoopWithIntro(s, start, end-start)
+		t.length = -1
+	}
+	return t, nil
+}
+
+// read fills b as far as the track goes, reporting whether it has more.
+func (t *track) read(b []byte) (int, bool) {
+	if t.length >= 0 {
+		b = b[:min(int64(len(b)), t.length)]
+	}
+	n, err := io.ReadFull(t.src, b)
+	if t.length >= 0 {
+		t.length -= int64(n)
+	}
+	return n, err == nil && t.length != 0
+}
+
+func (t *track) close() { t.f.Close() }
+
+// loopPoints is the loop of a music file in frames at sampleRate: from an
+// Ogg file's LOOPSTART and LOOPLENGTH (or LOOPEND) comments, or from a
+// "<file>.loop.json" beside it with "start" and "end" in seconds. Without
+// either the whole file loops; end 0 means the end of the file.
+func loopPoints(path string, sampleRate int) (start, end int64) {
+	if b, err := os.ReadFile(path + ".loop.json"); err == nil {
+		var lp struct{ Start, End float64 }
+		if json.Unmarshal(b, &lp) == nil {
+			return int64(lp.Start * float64(sampleRate)), int64(lp.End * float64(sampleRate))
+		}
+	}
+	if strings.ToLower(filepath.Ext(path)) != ".ogg" {
+		return 0, 0
+	}
+	tags, rate, err := vorbisComments(path)
+	if err != nil || rate <= 0 {
+		return 0, 0
+	}
+	scale := func(key string) int64 {
+		n, _ := strconv.ParseInt(tags[key], 10, 64)
+		return int64(math.Round(float64(n) * float64(sampleRate) / float64(rate)))
+	}
+	start, end = scale("LOOPSTART"), scale("LOOPEND")
+	if l := scale("LOOPLENGTH"); l > 0 {
+		end = start + l
+	}
+	return start, end
+}
+
+// vorbisComments reads the comments and sample rate from the headers at
+// the start of an Ogg Vorbis file.
+func vorbisComments(path string) (map[string]string, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	head := make([]byte, 64<<10)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	errBad := errors.New("no vorbis headers")
+	id := bytes.Index(head, []byte("\x01vorbis"))
+	if id < 0 || id+16 > len(head) {
+		return nil, 0, errBad
+	}
+	rate := int(binary.LittleEndian.Uint32(head[id+12:]))
+	c := bytes.Index(head, []byte("\x03vorbis"))
+	if c < 0 {
+		return nil, 0, errBad
+	}
+	b := head[c+7:]
+	next := func() ([]byte, bool) {
+		if len(b) < 4 {
+			return nil, false
+		}
+		l := int(binary.LittleEndian.Uint32(b))
+		if l < 0 || l > len(b)-4 {
+			return nil, false
+		}
+		s := b[4 : 4+l]
+		b = b[4+l:]
+		return s, true
+	}
+	if _, ok := next(); !ok { // vendor
+		return nil, 0, errBad
+	}
+	if len(b) < 4 {
+		return nil, 0, errBad
+	}
+	count := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+	tags := make(map[string]string)
+	for i := 0; i < count; i++ {
+		s, ok := next()
+		if !ok {
+			break
+		}
+		if k, v, ok := strings.Cut(string(s), "="); ok {
+			tags[strings.ToUpper(k)] = v
+		}
+	}
+	return tags, rate, nil
+}
+
+// playlist streams a Playlist to the mixer. The next track is decoded in
+// the background and crossfaded in as the current one ends.
+type playlist struct {
+	mu         sync.Mutex
+	sampleRate int
+	opts       Playlist
+	tracks     []string
+	order      []int // play order, indexes into tracks
+	at         int   // position in order of the current track
+	rng        *rand.Rand
+	cur, old   *track
+	fLen       int    // frames of crossfade between tracks
+	fade       int    // frames left of the crossfade in progress
+	fadeLen    int    // frames in the crossfade in progress
+	ready      *track // the next track, decoded and waiting
+	loading    bool
+	skip       bool // move on to the next track now
+	failed     int  // tracks in a row that would not decode
+	buf        []byte
+	oldBuf     []byte
+	closed     bool
+}
+
+func newPlaylist(sampleRate int, opts Playlist, tracks []string) *playlist {
+	p := &playlist{
+		sampleRate: sampleRate,
+		opts:       opts,
+		tracks:     tracks,
+		rng:        rand.New(rand.NewSource(rand.Int63())),
+		fLen:       int(max(0, opts.Crossfade) * float64(sampleRate)),
+		at:         -1,
+	}
+	p.shuffle()
+	p.load()
+	return p
+}
+
+// shuffle sets the play order for a pass through the tracks, never
+// starting with the track that ended the last pass.
+func (p *playlist) shuffle() {
+	last := -1
+	if len(p.order) > 0 {
+		last = p.order[len(p.order)-1]
+	}
+	p.order = make([]int, len(p.tracks))
+	for i := range p.order {
+		p.order[i] = i
+	}
+	if p.opts.Shuffle {
+		p.rng.Shuffle(len(p.order), func(i, j int) { p.order[i], p.order[j] = p.order[j], p.order[i] })
+		if n := len(p.order); n > 1 && p.order[0] == last {
+			p.order[0], p.order[n-1] = p.order[n-1], p.order[0]
+		}
+	}
+}
+
+// loops reports whether tracks repeat on their own rather than moving on.
+func (p *playlist) loops() bool {
+	return p.opts.Repeat == "one" || (p.opts.Repeat != "off" && len(p.tracks) == 1)
+}
+
+// load decodes the track after the current one in the background. Callers
+// hold mu.
+func (p *playlist) load() {
+	if p.loading || p.ready != nil || p.closed || p.failed >= len(p.tracks) {
+		return
+	}
+	next := p.at + 1
+	if next >= len(p.order) {
+		if p.opts.Repeat == "off" && p.at >= 0 {
+			return
+		}
+		p.shuffle()
+		next = 0
+	}
+	p.at = next
+	p.loading = true
+	path, loop := p.tracks[p.order[next]], p.loops()
+	go func() {
+		t, err := openTrack(path, p.sampleRate, loop)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.loading = false
+		switch {
+		case p.closed:
+			if t != nil {
+				t.close()
+			}
+		case err != nil:
+			p.failed++
+			p.load()
+		default:
+			p.failed = 0
+			p.ready = t
+		}
+	}()
+}
+
+// next skips to the following track.
+func (p *playlist) next() {
+	p.mu.Lock()
+	p.skip = true
+	p.load()
+	p.mu.Unlock()
+}
+
+// close stops decoding and releases the files.
+func (p *playlist) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, t := range []*track{p.cur, p.old, p.ready} {
+		if t != nil {
+			t.close()
+		}
+	}
+	p.cur, p.old, p.ready = nil, nil, nil
+}
+
+// fill renders the next len(out)/2 frames of interleaved stereo.
+func (p *playlist) fill(out []float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clear(out)
+	frames := len(out) / 2
+	for f := 0; f < frames; {
+		n := frames - f
+		if p.cur == nil || p.skip || (p.fade == 0 && p.cur.length >= 0 && p.cur.length/4 <= int64(p.fLen)) {
+			p.advance()
+		}
+		if p.cur == nil {
+			return
+		}
+		if p.fade > 0 {
+			n = min(n, p.fade)
+		}
+		n = p.mix(out[f*2:(f+n)*2], n)
+		if n == 0 {
+			continue
+		}
+		f += n
+	}
+}
+
+// advance starts the next track if it is ready: straight away if nothing
+// is playing, otherwise crossfading over whatever the current one has left.
+func (p *playlist) advance() {
+	if p.ready == nil {
+		p.load()
+		return
+	}
+	p.skip = false
+	if p.old != nil {
+		p.old.close()
+	}
+	p.old, p.cur, p.ready = p.cur, p.ready, nil
+	p.fade = 0
+	if p.old != nil {
+		// even without a crossfade, a skip fades briefly rather than click
+		p.fade = max(p.fLen, int(crossfade*float64(p.sampleRate)))
+		if p.old.length >= 0 {
+			p.fade = min(p.fade, int(p.old.length/4))
+		}
+		if p.fade == 0 {
+			p.old.close()
+			p.old = nil
+		}
+	}
+	p.fadeLen = p.fade
+	p.load()
+}
+
+// mix adds up to n frames of the current track, and the old one while it
+// fades, to out. It returns the frames played; 0 means the current track
+// ended and another should start.
+func (p *playlist) mix(out []float64, n int) int {
+	if cap(p.buf) < n*4 {
+		p.buf = make([]byte, n*4)
+	}
+	got, more := p.cur.read(p.buf[:n*4])
+	got /= 4
+	if !more && got < n {
+		p.cur.close()
+		p.cur = nil
+	}
+	for i := 0; i < got*2; i++ {
+		out[i] = float64(int16(binary.LittleEndian.Uint16(p.buf[i*2:])))
+	}
+	if p.fade > 0 && p.old != nil {
+		if cap(p.oldBuf) < got*4 {
+			p.oldBuf = make([]byte, got*4)
+		}
+		old, _ := p.old.read(p.oldBuf[:got*4])
+		for i := 0; i < got; i++ {
+			// equal-power crossfade
+			x := float64(p.fade-i) / float64(p.fadeLen)
+			in, outGain := math.Sin((1-x)*math.Pi/2), math.Sin(x*math.Pi/2)
+			for c := 0; c < 2; c++ {
+				v := out[i*2+c] * in
+				if (i*2+c)*2 < old {
+					v += float64(int16(binary.LittleEndian.Uint16(p.oldBuf[(i*2+c)*2:]))) * outGain
+				}
+				out[i*2+c] = v
+			}
+		}
+		p.fade -= got
+		if p.fade <= 0 {
+			p.fade = 0
+			p.old.close()
+			p.old = nil
+		}
+	}
+	return got
+}
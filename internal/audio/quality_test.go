@@ -0,0 +1,117 @@
+package audio
+
+import (
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+// Limits the renderer is held to. A naive square or saw at aliasFreq
+// measures about -11 dB of aliasing; PolyBLEP brings them under -26.
+const (
+	maxPeakDB  = -0.1  // dBFS no render may exceed
+	maxDC      = 0.2   // largest mean offset, in percent of full scale
+	maxAliasDB = -24.0 // largest aliased energy relative to the whole tone
+	aliasFreq  = 3001.0
+	aliasSize  = 1 << 14 // samples in the aliasing measurement
+)
+
+// TestPeak renders every built-in song and effect and checks its peak
+// level and DC offset.
+func TestPeak(t *testing.T) {
+	err := eachRender(44100, func(name string, p PCM) {
+		peak, mean := levels(p.Samples)
+		if db := 20 * math.Log10(max(peak, 1)/fullScale); db > maxPeakDB {
+			t.Errorf("%s peaks at %.2f dBFS, over %.2f", name, db, maxPeakDB)
+		}
+		if dc := 100 * math.Abs(mean) / fullScale; dc > maxDC {
+			t.Errorf("%s has a DC offset of %.2f%% of full scale, over %.2f", name, dc, maxDC)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAliasing checks that the band-limited oscillators stay clean at a
+// high pitch, and that the measurement catches a naive one that does not.
+func TestAliasing(t *testing.T) {
+	for _, wave := range []string{"square", "saw"} {
+		db := aliasing(func(phase, inc float64) float64 { return oscillator(wave, phase, inc, 0.5, nil) }, 44100)
+		if db > maxAliasDB {
+			t.Errorf("%s aliases at %.2f dB, over %.2f", wave, db, maxAliasDB)
+		}
+		// PolyBLEP does nothing when told the phase does not advance
+		db = aliasing(func(phase, _ float64) float64 { return oscillator(wave, phase, 0, 0.5, nil) }, 44100)
+		if db <= maxAliasDB {
+			t.Errorf("naive %s measures %.2f dB of aliasing, within the %.2f limit", wave, db, maxAliasDB)
+		}
+	}
+}
+
+// levels returns the largest absolute sample and the mean of samples.
+func levels(samples []int16) (peak, mean float64) {
+	var sum float64
+	for _, s := range samples {
+		peak = max(peak, math.Abs(float64(s)))
+		sum += float64(s)
+	}
+	if len(samples) > 0 {
+		mean = sum / float64(len(samples))
+	}
+	return peak, mean
+}
+
+// aliasing plays osc at aliasFreq and returns, in dB, how much of its
+// energy lies away from the harmonics of that pitch: anything there has
+// folded back from above Nyquist.
+func aliasing(osc func(phase, inc float64) float64, sampleRate int) float64 {
+	sr := float64(sampleRate)
+	inc := aliasFreq / sr
+	x := make([]complex128, aliasSize)
+	var phase float64
+	for i := range x {
+		hann := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/aliasSize)
+		x[i] = complex(osc(phase, inc)*hann, 0)
+		phase = math.Mod(phase+inc, 1)
+	}
+	fft(x)
+	binHz := sr / aliasSize
+	var total, alias float64
+	for k := 1; k < aliasSize/2; k++ {
+		power := real(x[k])*real(x[k]) + imag(x[k])*imag(x[k])
+		total += power
+		f := float64(k) * binHz
+		// the window spreads each harmonic over a few bins either side
+		if math.Abs(f-math.Round(f/aliasFreq)*aliasFreq) > 4*binHz {
+			alias += power
+		}
+	}
+	return 10 * math.Log10(max(alias, 1e-30)/total)
+}
+
+// fft transforms x in place; len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j |= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Rect(1, -2*math.Pi/float64(size))
+		for start := 0; start < n; start += size {
+			t := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], x[start+k+size/2]*t
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				t *= w
+			}
+		}
+	}
+}
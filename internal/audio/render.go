@@ -0,0 +1,153 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// PCM is rendered audio as interleaved 16-bit samples.
+type PCM struct {
+	SampleRate int
+	Channels   int
+	Samples    []int16
+}
+
+// RenderSong renders loops repetitions of a song (see LoadSong) with every
+// layer playing.
+func RenderSong(style string, sampleRate, loops int) (PCM, error) {
+	song, err := LoadSong(style)
+	if err != nil {
+		return PCM{}, err
+	}
+	loop := pcm16(song.Render(sampleRate))
+	out := PCM{SampleRate: sampleRate, Channels: 2}
+	for i := 0; i < max(1, loops); i++ {
+		out.Samples = append(out.Samples, loop...)
+	}
+	return out, nil
+}
+
+// RenderEffect renders a sound effect: one the game plays, a preset, or a
+// variation of a preset if seed is not zero.
+func RenderEffect(name string, seed int64, sampleRate int) (PCM, error) {
+	e, ok := defaultEffects[name]
+	if p, preset := Presets[name]; preset {
+		e, ok = p, true
+	}
+	if seed != 0 {
+		var err error
+		if e, err = Randomize(name, seed); err != nil {
+			return PCM{}, err
+		}
+		ok = true
+	}
+	if !ok {
+		return PCM{}, fmt.Errorf("unknown effect %q", name)
+	}
+	return PCM{SampleRate: sampleRate, Channels: 1, Samples: e.Render(sampleRate)}, nil
+}
+
+// Stereo returns p with two channels, copying mono to both sides.
+func (p PCM) Stereo() PCM {
+	if p.Channels == 2 {
+		return p
+	}
+	out := PCM{SampleRate: p.SampleRate, Channels: 2, Samples: make([]int16, len(p.Samples)*2)}
+	for i, s := range p.Samples {
+		out.Samples[i*2], out.Samples[i*2+1] = s, s
+	}
+	return out
+}
+
+// Mono returns p with one channel, averaging stereo sides.
+func (p PCM) Mono() PCM {
+	if p.Channels == 1 {
+		return p
+	}
+	out := PCM{SampleRate: p.SampleRate, Channels: 1, Samples: make([]int16, len(p.Samples)/2)}
+	for i := range out.Samples {
+		out.Samples[i] = int16((int(p.Samples[i*2]) + int(p.Samples[i*2+1])) / 2)
+	}
+	return out
+}
+
+// Hash is the SHA-256 of the samples, for spotting changes to the synths.
+func (p PCM) Hash() string {
+	h := sha256.New()
+	_ = binary.Write(h, binary.LittleEndian, p.Samples)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// WriteWAV writes p as a PCM WAV file with 16 or 24 bits per sample.
+func (p PCM) WriteWAV(w io.Writer, bits int) error {
+	if bits != 16 && bits != 24 {
+		return fmt.Errorf("unsupported bit depth %d (want 16 or 24)", bits)
+	}
+	width := bits / 8
+	data := uint32(len(p.Samples) * width)
+	buf := bufio.NewWriter(w)
+	// RIFF header
+	buf.WriteString("RIFF")
+	binary.Write(buf, binary.LittleEndian, 36+data)
+	buf.WriteString("WAVE")
+	// fmt chunk
+	buf.WriteString("fmt ")
+	binary.Write(buf, binary.LittleEndian, uint32(16))                            // Subchunk1Size
+	binary.Write(buf, binary.LittleEndian, uint16(1))                             // AudioFormat PCM
+	binary.Write(buf, binary.LittleEndian, uint16(p.Channels))                    // NumChannels
+	binary.Write(buf, binary.LittleEndian, uint32(p.SampleRate))                  // SampleRate
+	binary.Write(buf, binary.LittleEndian, uint32(p.SampleRate*p.Channels*width)) // ByteRate
+	binary.Write(buf, binary.LittleEndian, uint16(p.Channels*width))              // BlockAlign
+	binary.Write(buf, binary.LittleEndian, uint16(bits))                          // BitsPerSample
+	// data chunk
+	buf.WriteString("data")
+	binary.Write(buf, binary.LittleEndian, data)
+	for _, s := range p.Samples {
+		if bits == 24 {
+			v := int32(s) << 8
+			buf.Write([]byte{byte(v), byte(v >> 8), byte(v >> 16)})
+		} else {
+			binary.Write(buf, binary.LittleEndian, s)
+		}
+	}
+	return buf.Flush()
+}
+
+// Hashes renders every built-in song and effect at sampleRate and lists
+// their hashes in sha256sum format, so CI can compare them against a
+// recorded golden list without a sound card.
+func Hashes(sampleRate int) ([]byte, error) {
+	var out bytes.Buffer
+	err := eachRender(sampleRate, func(name string, p PCM) {
+		fmt.Fprintf(&out, "%s  %s\n", p.Hash(), name)
+	})
+	return out.Bytes(), err
+}
+
+// eachRender renders every built-in song (as "song/NAME"), effect preset
+// ("sfx/NAME") and game effect ("game/NAME") in turn and hands it to fn.
+func eachRender(sampleRate int, fn func(name string, p PCM)) error {
+	for _, name := range SongNames() {
+		p, err := RenderSong(name, sampleRate, 1)
+		if err != nil {
+			return err
+		}
+		fn("song/"+name, p)
+	}
+	for _, name := range EffectKinds {
+		p, err := RenderEffect(name, 0, sampleRate)
+		if err != nil {
+			return err
+		}
+		fn("sfx/"+name, p)
+	}
+	for _, name := range GameEffects() {
+		fn("game/"+name, PCM{SampleRate: sampleRate, Channels: 1, Samples: defaultEffects[name].Render(sampleRate)})
+	}
+	return nil
+}
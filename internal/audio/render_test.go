@@ -0,0 +1,57 @@
+package audio
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden.sha256 from the current renders")
+
+// TestGoldenHashes renders every built-in song and effect and compares the
+// hashes with golden.sha256, so a change to the synths that alters their
+// output shows up. Run with -update when the change is intended. The
+// hashes are recorded on amd64; other architectures may round differently.
+func TestGoldenHashes(t *testing.T) {
+	got, err := Hashes(44100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := os.WriteFile("golden.sha256", got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	golden, err := os.ReadFile("golden.sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, have := parseHashes(golden), parseHashes(got)
+	for name, sum := range want {
+		switch have[name] {
+		case "":
+			t.Errorf("%s: not rendered", name)
+		case sum:
+		default:
+			t.Errorf("%s: hash %s, want %s", name, have[name], sum)
+		}
+	}
+	for name := range have {
+		if want[name] == "" {
+			t.Errorf("%s: missing from golden.sha256", name)
+		}
+	}
+}
+
+// parseHashes reads sha256sum output into a map from name to hash.
+func parseHashes(b []byte) map[string]string {
+	m := make(map[string]string)
+	for _, line := range strings.Split(string(b), "\n") {
+		if sum, name, ok := strings.Cut(strings.TrimSpace(line), "  "); ok {
+			m[name] = sum
+		}
+	}
+	return m
+}
@@ -0,0 +1,81 @@
+package audio
+
+// reverb is a small stereo Freeverb-style room: parallel damped comb
+// filters into allpass diffusers, with slightly different delays per side
+// so the tail is wide without leaving either ear dry.
+type reverb struct {
+	combs     [2][4]comb
+	allpasses [2][2]allpass
+}
+
+const (
+	reverbFeedback = 0.8  // room size; longer tails towards 1
+	reverbDamp     = 0.35 // high-frequency loss in the tail
+	reverbInput    = 0.12 // gain into the combs
+	reverbWidth    = 0.7  // 1 = fully separate sides, 0 = mono
+	reverbSpread   = 23   // extra samples of delay on the right at 44.1 kHz
+)
+
+// Delays in samples at 44.1 kHz, from Freeverb.
+var (
+	combDelays    = [4]int{1116, 1188, 1277, 1356}
+	allpassDelays = [2]int{556, 441}
+)
+
+func newReverb(sampleRate int) *reverb {
+	scale := func(n int) int { return max(1, n*sampleRate/44100) }
+	r := &reverb{}
+	for side := range r.combs {
+		for i, d := range combDelays {
+			r.combs[side][i].buf = make([]float64, scale(d+side*reverbSpread))
+		}
+		for i, d := range allpassDelays {
+			r.allpasses[side][i].buf = make([]float64, scale(d+side*reverbSpread))
+		}
+	}
+	return r
+}
+
+// process feeds one mono sample in and returns the next wet stereo frame.
+func (r *reverb) process(in float64) (left, right float64) {
+	var out [2]float64
+	in *= reverbInput
+	for side := range out {
+		for i := range r.combs[side] {
+			out[side] += r.combs[side][i].process(in)
+		}
+		for i := range r.allpasses[side] {
+			out[side] = r.allpasses[side][i].process(out[side])
+		}
+	}
+	wet1, wet2 := (1+reverbWidth)/2, (1-reverbWidth)/2
+	return out[0]*wet1 + out[1]*wet2, out[1]*wet1 + out[0]*wet2
+}
+
+// comb is a feedback delay with a one-pole low-pass in the loop.
+type comb struct {
+	buf   []float64
+	pos   int
+	store float64
+}
+
+func (c *comb) process(in float64) float64 {
+	out := c.buf[c.pos]
+	c.store = out*(1-reverbDamp) + c.store*reverbDamp
+	c.buf[c.pos] = in + c.store*reverbFeedback
+	c.pos = (c.pos + 1) % len(c.buf)
+	return out
+}
+
+// allpass smears echoes in time without colouring them.
+type allpass struct {
+	buf []float64
+	pos int
+}
+
+func (a *allpass) process(in float64) float64 {
+	b := a.buf[a.pos]
+	a.buf[a.pos] = in + b*0.5
+	a.pos = (a.pos + 1) % len(a.buf)
+	return b - in
+}
@@ -0,0 +1,307 @@
+package audio
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+// Effect describes a sound effect in the style of sfxr: an oscillator
+// with pitch and duty modulation, an envelope and a pair of filters.
+// Times are seconds, slides are octaves per second and filter cutoffs Hz.
+type Effect struct {
+	Wave       string  `json:"wave"` // square, saw, triangle, sine or noise
+	Volume     float64 `json:"volume"`
+	BaseFreq   float64 `json:"baseFreq"`
+	MinFreq    float64 `json:"minFreq"` // the sound stops if a slide falls below this
+	Slide      float64 `json:"slide"`
+	DeltaSlide float64 `json:"deltaSlide"` // change of slide per second
+	Vibrato    float64 `json:"vibrato"`    // depth in semitones
+	VibratoHz  float64 `json:"vibratoHz"`
+	Arpeggio   float64 `json:"arpeggio"`   // pitch ratio jumped to after ArpeggioAt
+	ArpeggioAt float64 `json:"arpeggioAt"` // seconds
+	Duty       float64 `json:"duty"`
+	DutySweep  float64 `json:"dutySweep"` // change of duty per second
+	Attack     float64 `json:"attack"`
+	Sustain    float64 `json:"sustain"`
+	Punch      float64 `json:"punch"` // extra level at the start of the sustain, 0-1
+	Decay      float64 `json:"decay"`
+	LowPass    float64 `json:"lowPass"`      // 0 = off
+	LowSweep   float64 `json:"lowPassSweep"` // octaves per second
+	Resonance  float64 `json:"resonance"`    // 0-1
+	HighPass   float64 `json:"highPass"`     // 0 = off
+	HighSweep  float64 `json:"highPassSweep"`
+	Bus        string  `json:"bus"`    // "sfx" (default) or "ui"
+	Duck       bool    `json:"duck"`   // duck the music while it plays
+	Reverb     float64 `json:"reverb"` // share sent to the reverb, 0-1
+}
+
+// EffectKinds are the kinds Randomize generates and Presets holds.
+var EffectKinds = []string{"pickup", "hit", "explosion", "jump", "menu"}
+
+// Presets are a ready-made effect of each kind.
+var Presets = map[string]Effect{
+	"pickup":    {Wave: "square", Volume: 0.35, BaseFreq: 988, Arpeggio: 1.335, ArpeggioAt: 0.06, Duty: 0.5, Sustain: 0.06, Punch: 0.4, Decay: 0.25, Reverb: 0.3},
+	"hit":       {Wave: "noise", Volume: 0.5, BaseFreq: 600, Slide: -3, Sustain: 0.04, Punch: 0.5, Decay: 0.2, LowPass: 4000, LowSweep: -2, Duck: true, Reverb: 0.2},
+	"explosion": {Wave: "noise", Volume: 0.35, BaseFreq: 120, Slide: -0.4, Sustain: 0.25, Punch: 0.7, Decay: 0.7, LowPass: 2500, LowSweep: -1.5, Resonance: 0.3, Duck: true, Reverb: 0.4},
+	"jump":      {Wave: "square", Volume: 0.35, BaseFreq: 440, Slide: 2.2, Duty: 0.3, DutySweep: 0.6, Sustain: 0.1, Decay: 0.18, HighPass: 120, Reverb: 0.2},
+	"menu":      {Wave: "square", Volume: 0.3, BaseFreq: 660, Duty: 0.5, Sustain: 0.05, Decay: 0.06, HighPass: 150, Bus: "ui"},
+}
+
+// defaultEffects are the sounds the game plays, by name; an effects file
+// may redefine them. The last three are placed in the world (see PlayAt).
+var defaultEffects = map[string]Effect{
+	"start":        Presets["menu"],
+	"submit":       Presets["pickup"],
+	"hit":          Presets["hit"],
+	"obstacle":     {Wave: "noise", Volume: 0.25, BaseFreq: 2000, Slide: -1, Attack: 0.25, Decay: 0.6, LowPass: 3000, LowSweep: -1.5, HighPass: 300},
+	"satellite":    {Wave: "sine", Volume: 0.2, BaseFreq: 1760, Arpeggio: 0.75, ArpeggioAt: 0.08, Sustain: 0.15, Decay: 0.3, Reverb: 0.5},
+	"shootingStar": {Wave: "triangle", Volume: 0.2, BaseFreq: 2400, Slide: -1.2, Vibrato: 0.5, VibratoHz: 18, Attack: 0.02, Sustain: 0.1, Decay: 0.5, Reverb: 0.6},
+}
+
+// GameEffects lists the names of the sounds the game plays.
+func GameEffects() []string {
+	names := make([]string, 0, len(defaultEffects))
+	for name := range defaultEffects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var effectWaves = map[string]bool{"square": true, "saw": true, "triangle": true, "sine": true, "noise": true}
+
+// Randomize returns a random effect of the given kind. The same seed always
+// gives the same effect.
+func Randomize(kind string, seed int64) (Effect, error) {
+	r := rand.New(rand.NewSource(seed))
+	rnd := func(lo, hi float64) float64 { return lo + r.Float64()*(hi-lo) }
+	pick := func(w ...string) string { return w[r.Intn(len(w))] }
+	e := Effect{Volume: 0.4, Duty: rnd(0.2, 0.6)}
+	switch kind {
+	case "pickup":
+		e.Wave = pick("square", "saw", "sine")
+		e.BaseFreq = rnd(700, 1800)
+		e.Sustain, e.Punch, e.Decay = rnd(0, 0.1), rnd(0.3, 0.6), rnd(0.1, 0.4)
+		if r.Intn(2) == 0 {
+			e.Arpeggio, e.ArpeggioAt = rnd(1.2, 1.6), rnd(0.03, 0.1)
+		}
+	case "hit":
+		e.Wave = pick("square", "saw", "noise")
+		e.BaseFreq = rnd(200, 900)
+		e.Slide = rnd(-4, -1)
+		e.Sustain, e.Punch, e.Decay = rnd(0, 0.08), rnd(0.2, 0.6), rnd(0.1, 0.3)
+		if r.Intn(2) == 0 {
+			e.HighPass = rnd(100, 600)
+		}
+		e.Duck = true
+	case "explosion":
+		e.Wave = "noise"
+		e.BaseFreq = rnd(40, 200)
+		e.Slide = rnd(-0.8, 0.3)
+		e.Sustain, e.Punch, e.Decay = rnd(0.1, 0.4), rnd(0.3, 0.8), rnd(0.4, 0.9)
+		e.LowPass, e.LowSweep, e.Resonance = rnd(1500, 6000), rnd(-2, 0), rnd(0, 0.5)
+		if r.Intn(3) == 0 {
+			e.Vibrato, e.VibratoHz = rnd(0.5, 3), rnd(4, 20)
+		}
+		e.Volume, e.Duck = 0.5, true
+	case "jump":
+		e.Wave = pick("square", "square", "sine")
+		e.BaseFreq = rnd(250, 700)
+		e.Slide = rnd(1, 3.5)
+		e.DutySweep = rnd(-0.5, 0.5)
+		e.Sustain, e.Decay = rnd(0.05, 0.25), rnd(0.1, 0.3)
+		if r.Intn(2) == 0 {
+			e.HighPass = rnd(80, 300)
+		}
+	case "menu":
+		e.Wave = pick("square", "saw", "triangle")
+		e.BaseFreq = rnd(400, 1200)
+		e.Sustain, e.Decay = rnd(0.02, 0.08), rnd(0.02, 0.1)
+		e.HighPass, e.Bus = 100, "ui"
+	default:
+		return Effect{}, fmt.Errorf("unknown effect kind %q", kind)
+	}
+	return e, nil
+}
+
+// effectSpec is an entry of an effects file: an effect built from a preset
+// ("from"), optionally randomised ("seed"), with any field overridden.
+type effectSpec struct {
+	From string `json:"from"`
+	Seed int64  `json:"seed"`
+}
+
+// LoadEffects reads an effects file, a JSON object of named effects.
+func LoadEffects(path string) (map[string]Effect, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	effects := make(map[string]Effect, len(raw))
+	var errs []error
+	for _, name := range names {
+		e, err := parseEffect(raw[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: effect %q: %w", path, name, err))
+			continue
+		}
+		effects[name] = e
+	}
+	return effects, errors.Join(errs...)
+}
+
+func parseEffect(raw json.RawMessage) (Effect, error) {
+	var spec effectSpec
+	if err := json.Unmarshal(raw, &spec); err != nil {
+		return Effect{}, err
+	}
+	e := Effect{Wave: "square", Volume: 0.4, BaseFreq: 440, Duty: 0.5, Sustain: 0.1, Decay: 0.2}
+	switch {
+	case spec.From != "" && spec.Seed != 0:
+		var err error
+		if e, err = Randomize(spec.From, spec.Seed); err != nil {
+			return Effect{}, err
+		}
+	case spec.From != "":
+		p, ok := Presets[spec.From]
+		if !ok {
+			return Effect{}, fmt.Errorf("unknown preset %q", spec.From)
+		}
+		e = p
+	}
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return Effect{}, err
+	}
+	switch {
+	case !effectWaves[e.Wave]:
+		return Effect{}, fmt.Errorf("unknown wave %q", e.Wave)
+	case e.Bus != "" && e.Bus != "sfx" && e.Bus != "ui":
+		return Effect{}, fmt.Errorf("unknown bus %q", e.Bus)
+	case e.Attack < 0 || e.Sustain < 0 || e.Decay < 0 || e.Attack+e.Sustain+e.Decay > 5:
+		return Effect{}, errors.New("envelope must be 0-5 seconds long")
+	case e.BaseFreq <= 0:
+		return Effect{}, errors.New("baseFreq must be positive")
+	case e.Reverb < 0 || e.Reverb > 1:
+		return Effect{}, errors.New("reverb must be 0-1")
+	}
+	return e, nil
+}
+
+// fadeEnds fades the first and last ramp samples of pcm in and out.
+func fadeEnds(pcm []int16, ramp int) {
+	ramp = min(ramp, len(pcm)/2)
+	for i := 0; i < ramp; i++ {
+		g := float64(i) / float64(ramp)
+		pcm[i] = int16(float64(pcm[i]) * g)
+		pcm[len(pcm)-1-i] = int16(float64(pcm[len(pcm)-1-i]) * g)
+	}
+}
+
+// bus is the mixer bus the effect plays on.
+func (e Effect) bus() Bus {
+	if e.Bus == "ui" {
+		return UI
+	}
+	return SFX
+}
+
+// Render synthesises the effect as PCM16 mono samples. Its ends are faded
+// over a couple of milliseconds so it never clicks.
+func (e Effect) Render(sampleRate int) []int16 {
+	sr := float64(sampleRate)
+	dt := 1 / sr
+	a, s, d := int(e.Attack*sr), int(e.Sustain*sr), int(e.Decay*sr)
+	pcm := make([]int16, a+s+d)
+	ramp := int(minRamp * sr)
+	defer func() { fadeEnds(pcm, ramp) }()
+	rng := rand.New(rand.NewSource(1))
+	var noise [32]float64
+	for i := range noise {
+		noise[i] = rng.Float64()*2 - 1
+	}
+	freq, slide := e.BaseFreq, e.Slide
+	duty := e.Duty
+	if duty <= 0 {
+		duty = 0.5
+	}
+	var phase, low, band, hpIn, hpOut float64
+	var dc dcBlocker
+	pole := dcPole(sampleRate)
+	lowCut, highCut := e.LowPass, e.HighPass
+	for i := range pcm {
+		t := float64(i) * dt
+		if e.Arpeggio > 0 && t >= e.ArpeggioAt && t-dt < e.ArpeggioAt {
+			freq *= e.Arpeggio
+		}
+		freq *= math.Pow(2, slide*dt)
+		slide += e.DeltaSlide * dt
+		if e.MinFreq > 0 && freq < e.MinFreq {
+			pcm = pcm[:i]
+			return pcm
+		}
+		f := freq * math.Pow(2, e.Vibrato*math.Sin(2*math.Pi*e.VibratoHz*t)/12)
+		duty = max(0.05, min(0.95, duty+e.DutySweep*dt))
+
+		phase += f * dt
+		if phase >= 1 {
+			phase -= math.Floor(phase)
+			if e.Wave == "noise" {
+				for j := range noise {
+					noise[j] = rng.Float64()*2 - 1
+				}
+			}
+		}
+		var v float64
+		switch e.Wave {
+		case "noise":
+			v = noise[int(phase*32)%32]
+		default:
+			v = oscillator(e.Wave, phase, f*dt, duty, nil)
+		}
+
+		if lowCut > 0 {
+			// state variable low-pass, kept below a sixth of the rate to stay stable
+			fc := min(lowCut, sr/6)
+			k := 2 * math.Sin(math.Pi*fc/sr)
+			q := 1 - 0.9*max(0, min(1, e.Resonance))
+			low += k * band
+			band += k * (v - low - q*band)
+			v = low
+			lowCut *= math.Pow(2, e.LowSweep*dt)
+		}
+		if highCut > 0 {
+			rc := 1 / (2 * math.Pi * highCut)
+			alpha := rc / (rc + dt)
+			hpOut = alpha * (hpOut + v - hpIn)
+			hpIn = v
+			v = hpOut
+			highCut = max(1, highCut*math.Pow(2, e.HighSweep*dt))
+		}
+
+		env := 1.0
+		switch {
+		case i < a:
+			env = float64(i) / float64(a)
+		case i < a+s:
+			env = 1 + e.Punch*(1-float64(i-a)/float64(s))
+		default:
+			env = 1 - float64(i-a-s)/float64(d)
+		}
+		pcm[i] = clip16(dc.process(v*env*e.Volume*fullScale, pole))
+	}
+	return pcm
+}
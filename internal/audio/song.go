@@ -0,0 +1,361 @@
+package audio
+
+import (
+	"embed"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed songs
+var songFiles embed.FS
+
+// Song is a loop of notes on channels, timed in steps.
+type Song struct {
+	Name         string
+	Tempo        float64 // beats per minute
+	BeatsPerBar  int
+	StepsPerBeat int
+	Length       int // in steps
+	Channels     []Channel
+}
+
+// Channel is one voice of a song.
+type Channel struct {
+	Name  string
+	Layer string // one of Layers, or "stinger"
+	Notes []Note
+}
+
+// Note plays Freq Hz from Step for Len steps.
+type Note struct {
+	Step  int
+	Len   int
+	Freq  float64
+	Voice Instrument
+}
+
+// songFile is the JSON song format; see songs/ for examples.
+type songFile struct {
+	Tempo        float64                `json:"tempo"`
+	BeatsPerBar  int                    `json:"beatsPerBar"`
+	StepsPerBeat int                    `json:"stepsPerBeat"`
+	Instruments  map[string]Instrument  `json:"instruments"`
+	Patterns     map[string]patternFile `json:"patterns"`
+	Channels     []channelFile          `json:"channels"`
+}
+
+// patternFile lists notes either as steps, one token per step ("C4" starts
+// a note, "-" holds it, "." rests, "x" hits the instrument's own pitch and
+// "|" is ignored), or as notes that may override the instrument's envelope
+// and effects, e.g. {"step": 4, "len": 2, "note": "E5", "slide": -12}.
+type patternFile struct {
+	Steps  string            `json:"steps"`
+	Notes  []json.RawMessage `json:"notes"`
+	Length int               `json:"length"`
+}
+
+// channelFile plays patterns in order; "name*4" repeats one. Layer defaults
+// to the channel's name if that is a layer, otherwise to "pad".
+type channelFile struct {
+	Name       string   `json:"name"`
+	Layer      string   `json:"layer"`
+	Instrument string   `json:"instrument"`
+	Sequence   []string `json:"sequence"`
+}
+
+// Limits on songs, so a bad file fails to load instead of failing to
+// render: every layer of a loop is rendered into memory.
+const (
+	minTempo, maxTempo = 20, 400 // beats per minute
+	maxBeatsPerBar     = 16
+	maxStepsPerBeat    = 48
+	maxSongMinutes     = 5 // longest loop or stinger
+)
+
+// songExts are the song file formats: JSON songs and MIDI files.
+var songExts = []string{".json", ".mid"}
+
+// SongNames lists the built-in songs, usable as the music style.
+func SongNames() []string {
+	entries, _ := songFiles.ReadDir("songs")
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if ext := path.Ext(e.Name()); slices.Contains(songExts, ext) {
+			names = append(names, strings.TrimSuffix(e.Name(), ext))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadSong returns the built-in song of that name, or reads a song file if
+// style is a path ending in .json or .mid (see ParseMIDI).
+func LoadSong(style string) (*Song, error) {
+	var b []byte
+	var err error
+	file := style
+	if slices.Contains(songExts, path.Ext(style)) {
+		b, err = os.ReadFile(style)
+	} else {
+		err = fs.ErrNotExist
+		for _, ext := range songExts {
+			file = path.Join("songs", style+ext)
+			if b, err = songFiles.ReadFile(file); !errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("unknown song %q", style)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	parse := ParseSong
+	if path.Ext(file) == ".mid" {
+		parse = ParseMIDI
+	}
+	s, err := parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("song %s: %w", style, err)
+	}
+	s.Name = strings.TrimSuffix(path.Base(file), path.Ext(file))
+	return s, nil
+}
+
+// ParseSong compiles a song in the JSON song format.
+func ParseSong(b []byte) (*Song, error) {
+	var f songFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	if f.Tempo < minTempo || f.Tempo > maxTempo {
+		return nil, fmt.Errorf("tempo must be %d-%d BPM", minTempo, maxTempo)
+	}
+	s := &Song{Tempo: f.Tempo, BeatsPerBar: f.BeatsPerBar, StepsPerBeat: f.StepsPerBeat}
+	if s.BeatsPerBar <= 0 {
+		s.BeatsPerBar = 4
+	}
+	if s.StepsPerBeat <= 0 {
+		s.StepsPerBeat = 4
+	}
+	if s.BeatsPerBar > maxBeatsPerBar || s.StepsPerBeat > maxStepsPerBeat {
+		return nil, fmt.Errorf("a song has at most %d beats per bar and %d steps per beat", maxBeatsPerBar, maxStepsPerBeat)
+	}
+	maxSteps := int(maxSongMinutes * s.Tempo * float64(s.StepsPerBeat))
+	for name, in := range f.Instruments {
+		if !waves[in.Wave] {
+			return nil, fmt.Errorf("instrument %q: unknown wave %q", name, in.Wave)
+		}
+	}
+	for i, cf := range f.Channels {
+		if cf.Name == "" {
+			cf.Name = strconv.Itoa(i + 1)
+		}
+		in, ok := f.Instruments[cf.Instrument]
+		if !ok {
+			return nil, fmt.Errorf("channel %s: unknown instrument %q", cf.Name, cf.Instrument)
+		}
+		ch := Channel{Name: cf.Name, Layer: cf.Layer}
+		if ch.Layer == "" {
+			ch.Layer = "pad"
+			if layerIndex(cf.Name) >= 0 {
+				ch.Layer = cf.Name
+			}
+		}
+		if ch.Layer != stinger && layerIndex(ch.Layer) < 0 {
+			return nil, fmt.Errorf("channel %s: unknown layer %q", cf.Name, ch.Layer)
+		}
+		step := 0
+		for _, entry := range cf.Sequence {
+			name, times, err := repeat(entry)
+			if err != nil {
+				return nil, fmt.Errorf("channel %s: %w", cf.Name, err)
+			}
+			pf, ok := f.Patterns[name]
+			if !ok {
+				return nil, fmt.Errorf("channel %s: unknown pattern %q", cf.Name, name)
+			}
+			notes, length, err := pf.compile(in, maxSteps)
+			if err != nil {
+				return nil, fmt.Errorf("pattern %s: %w", name, err)
+			}
+			if length == 0 {
+				continue
+			}
+			if times > (maxSteps-step)/length {
+				return nil, fmt.Errorf("channel %s: longer than %d minutes", cf.Name, maxSongMinutes)
+			}
+			for ; times > 0; times-- {
+				for _, n := range notes {
+					n.Step += step
+					ch.Notes = append(ch.Notes, n)
+				}
+				step += length
+			}
+		}
+		if ch.Layer != stinger {
+			s.Length = max(s.Length, step)
+		}
+		s.Channels = append(s.Channels, ch)
+	}
+	if s.Length == 0 {
+		return nil, errors.New("song has no steps")
+	}
+	return s, nil
+}
+
+// repeat splits a sequence entry such as "arp*4".
+func repeat(entry string) (string, int, error) {
+	name, count, ok := strings.Cut(entry, "*")
+	if !ok {
+		return entry, 1, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return "", 0, fmt.Errorf("bad repeat count in %q", entry)
+	}
+	return name, n, nil
+}
+
+// compile turns the pattern into notes played on in. The pattern must end
+// within maxSteps.
+func (p patternFile) compile(in Instrument, maxSteps int) ([]Note, int, error) {
+	var notes []Note
+	step := 0
+	for _, tok := range strings.Fields(p.Steps) {
+		switch tok {
+		case "|":
+			continue
+		case ".":
+		case "-":
+			if len(notes) > 0 && notes[len(notes)-1].Step+notes[len(notes)-1].Len == step {
+				notes[len(notes)-1].Len++
+			}
+		default:
+			f, err := noteFreq(tok, in.Note)
+			if err != nil {
+				return nil, 0, fmt.Errorf("step %d: %w", step+1, err)
+			}
+			notes = append(notes, Note{Step: step, Len: 1, Freq: f, Voice: in})
+		}
+		step++
+	}
+	length := max(p.Length, step)
+	for _, raw := range p.Notes {
+		var spec struct {
+			Step int    `json:"step"`
+			Len  int    `json:"len"`
+			Note string `json:"note"`
+		}
+		voice := in
+		if err := json.Unmarshal(raw, &spec); err != nil {
+			return nil, 0, err
+		}
+		if err := json.Unmarshal(raw, &voice); err != nil {
+			return nil, 0, err
+		}
+		if spec.Step < 0 || spec.Len < 0 {
+			return nil, 0, fmt.Errorf("note at step %d: step and len must not be negative", spec.Step)
+		}
+		if spec.Len == 0 {
+			spec.Len = 1
+		}
+		if spec.Step > maxSteps || spec.Len > maxSteps-spec.Step {
+			return nil, 0, fmt.Errorf("note at step %d: ends after %d minutes", spec.Step, maxSongMinutes)
+		}
+		f, err := noteFreq(spec.Note, in.Note)
+		if err != nil {
+			return nil, 0, fmt.Errorf("note at step %d: %w", spec.Step, err)
+		}
+		if !waves[voice.Wave] {
+			return nil, 0, fmt.Errorf("note at step %d: unknown wave %q", spec.Step, voice.Wave)
+		}
+		notes = append(notes, Note{Step: spec.Step, Len: spec.Len, Freq: f, Voice: voice})
+		length = max(length, spec.Step+spec.Len)
+	}
+	if length > maxSteps {
+		return nil, 0, fmt.Errorf("longer than %d minutes", maxSongMinutes)
+	}
+	return notes, length, nil
+}
+
+var semitones = map[byte]int{'C': 0, 'D': 2, 'E': 4, 'F': 5, 'G': 7, 'A': 9, 'B': 11}
+
+// noteFreq parses a note name such as "A4", "C#5" or "Eb3"; "x" and ""
+// stand for def, itself defaulting to A4.
+func noteFreq(name, def string) (float64, error) {
+	if name == "x" || name == "" {
+		if def == "" {
+			return 440, nil
+		}
+		name = def
+	}
+	semi, ok := semitones[name[0]&^0x20]
+	if !ok {
+		return 0, fmt.Errorf("bad note %q", name)
+	}
+	rest := name[1:]
+	switch {
+	case strings.HasPrefix(rest, "#"):
+		semi, rest = semi+1, rest[1:]
+	case strings.HasPrefix(rest, "b"):
+		semi, rest = semi-1, rest[1:]
+	}
+	octave, err := strconv.Atoi(rest)
+	if err != nil {
+		return 0, fmt.Errorf("bad note %q", name)
+	}
+	return midiFreq((octave+1)*12 + semi), nil
+}
+
+// stepSample is the frame offset of a step.
+func (s *Song) stepSample(step, sampleRate int) int {
+	return int(math.Round(float64(step) * 60 * float64(sampleRate) / (s.Tempo * float64(s.StepsPerBeat))))
+}
+
+// Render mixes one loop of the song, all layers at full level, into PCM16
+// interleaved stereo samples with any DC offset removed.
+func (s *Song) Render(sampleRate int) []byte {
+	var tracks [][]int16
+	for i, ch := range s.Channels {
+		if ch.Layer != stinger {
+			tracks = append(tracks, s.renderChannel(sampleRate, i, s.Length))
+		}
+	}
+	mix := mixTracks(tracks...)
+	var dc [2]dcBlocker
+	pole := dcPole(sampleRate)
+	for i := 0; i+1 < len(mix); i += 2 {
+		v := float64(int16(binary.LittleEndian.Uint16(mix[i:])))
+		binary.LittleEndian.PutUint16(mix[i:], uint16(clip16(dc[i/2%2].process(v, pole))))
+	}
+	return mix
+}
+
+// renderChannel renders a channel into a stereo track length steps long.
+func (s *Song) renderChannel(sampleRate, ch, length int) []int16 {
+	out := make([]int16, s.stepSample(length, sampleRate)*2)
+	noise := newNoise(uint32(ch + 1))
+	for _, n := range s.Channels[ch].Notes {
+		start := s.stepSample(n.Step, sampleRate)
+		end := min(s.stepSample(n.Step+n.Len, sampleRate), len(out)/2)
+		if start >= end {
+			continue
+		}
+		for i, v := range notePCM(sampleRate, n.Voice, n.Freq, end-start, noise) {
+			out[start*2+i] = clip16(float64(out[start*2+i]) + float64(v))
+		}
+	}
+	return out
+}
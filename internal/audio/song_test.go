@@ -0,0 +1,74 @@
+package audio
+
+import (
+	"strings"
+	"testing"
+)
+
+// song builds a JSON song of one bass channel playing the pattern p.
+func song(tempo, stepsPerBeat, pattern, sequence string) []byte {
+	return []byte(`{"tempo": ` + tempo + `, "stepsPerBeat": ` + stepsPerBeat + `,
+		"instruments": {"bass": {"wave": "square", "note": "A2"}},
+		"patterns": {"p": ` + pattern + `},
+		"channels": [{"name": "bass", "instrument": "bass", "sequence": ["` + sequence + `"]}]}`)
+}
+
+func TestParseSong(t *testing.T) {
+	s, err := ParseSong(song("120", "4", `{"steps": "x - . x", "notes": [{"step": 6, "len": 2, "note": "E3"}]}`, "p*2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Length != 16 {
+		t.Errorf("length %d, want 16", s.Length)
+	}
+	want := []struct{ step, len int }{{0, 2}, {3, 1}, {6, 2}, {8, 2}, {11, 1}, {14, 2}}
+	notes := s.Channels[0].Notes
+	if len(notes) != len(want) {
+		t.Fatalf("%d notes, want %d", len(notes), len(want))
+	}
+	for i, w := range want {
+		if notes[i].Step != w.step || notes[i].Len != w.len {
+			t.Errorf("note %d at %d+%d, want %d+%d", i, notes[i].Step, notes[i].Len, w.step, w.len)
+		}
+	}
+	renderStems(s, 8000)
+}
+
+func TestParseSongBadInput(t *testing.T) {
+	steps := `{"steps": "x - . x"}`
+	for _, tc := range []struct {
+		name string
+		file []byte
+		err  string
+	}{
+		{"negative step", song("120", "4", `{"notes": [{"step": -8}]}`, "p"), "negative"},
+		{"negative len", song("120", "4", `{"notes": [{"step": 0, "len": -2}]}`, "p"), "negative"},
+		{"zero tempo", song("0", "4", steps, "p"), "tempo"},
+		{"fast tempo", song("1000", "4", steps, "p"), "tempo"},
+		{"many steps per beat", song("120", "100000", steps, "p"), "steps per beat"},
+		{"far step", song("120", "4", `{"notes": [{"step": 9223372036854775807}]}`, "p"), "minutes"},
+		{"long note", song("120", "4", `{"notes": [{"step": 0, "len": 1000000}]}`, "p"), "minutes"},
+		{"long pattern", song("120", "4", `{"steps": "x", "length": 1000000}`, "p"), "minutes"},
+		{"many repeats", song("120", "4", steps, "p*100000000"), "minutes"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseSong(tc.file)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("err = %v, want it to mention %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestBuiltinSongs(t *testing.T) {
+	for _, name := range []string{"chiptune", "synthwave"} {
+		s, err := LoadSong(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if s.Length == 0 || len(s.Channels) == 0 {
+			t.Errorf("%s has %d steps on %d channels", name, s.Length, len(s.Channels))
+		}
+	}
+}
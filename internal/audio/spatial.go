@@ -0,0 +1,30 @@
+package audio
+
+import "math"
+
+// Source places a sound in the game world, in screen pixels, moving at VX,
+// VY pixels per second so it pans as it flies past the listener.
+type Source struct {
+	X, Y   float64
+	VX, VY float64
+}
+
+const (
+	panSpan     = 400.0 // pixels left or right of the listener for a hard pan
+	halfLevel   = 250.0 // pixels from the listener at which a sound is at half level
+	distantSend = 0.4   // reverb send added as a sound moves far away
+)
+
+// spatial returns the left and right gains of src t seconds after it
+// started, heard from (lx, ly), and the extra reverb send its distance adds.
+// The pan is equal-power with a centred sound at full level on both sides.
+func spatial(src Source, t, lx, ly float64) (left, right, send float64) {
+	dx := src.X + src.VX*t - lx
+	dy := src.Y + src.VY*t - ly
+	pan := max(-1, min(1, dx/panSpan))
+	angle := (pan + 1) * math.Pi / 4
+	near := halfLevel / (halfLevel + math.Hypot(dx, dy))
+	left = min(1, math.Sqrt2*math.Cos(angle)) * near
+	right = min(1, math.Sqrt2*math.Sin(angle)) * near
+	return left, right, distantSend * (1 - near)
+}
@@ -0,0 +1,127 @@
+package audio
+
+import "math"
+
+// Instrument is how a channel's notes sound.
+type Instrument struct {
+	Wave   string  `json:"wave"`   // square, saw, triangle, sine, noise or kick
+	Volume float64 `json:"volume"` // peak level, 0-1
+	Note   string  `json:"note"`   // pitch of untuned "x" hits, default A4
+	Envelope
+	Effects
+}
+
+// Envelope shapes a note: it rises over Attack, falls to Sustain over Decay
+// and fades out over the last Release of the note. Times are milliseconds.
+// Without Decay or Sustain a note holds at full level.
+type Envelope struct {
+	Attack  float64 `json:"attack"`
+	Decay   float64 `json:"decay"`
+	Sustain float64 `json:"sustain"`
+	Release float64 `json:"release"`
+}
+
+// Effects modulate a note while it plays.
+type Effects struct {
+	Duty      float64 `json:"duty"`      // square pulse width, default 0.5
+	Detune    float64 `json:"detune"`    // cents; adds a second, detuned oscillator
+	Width     float64 `json:"width"`     // 0-1, spreads the detuned oscillators left and right
+	Slide     float64 `json:"slide"`     // semitones of pitch change over the note
+	Vibrato   float64 `json:"vibrato"`   // depth in semitones
+	VibratoHz float64 `json:"vibratoHz"` // vibrato rate
+}
+
+var waves = map[string]bool{"square": true, "saw": true, "triangle": true, "sine": true, "noise": true, "kick": true}
+
+// envelope is the level of sample i of a note frames long. The release
+// scales whatever stage the note has reached, so a note cut short still
+// fades out smoothly.
+func envelope(i, frames, a, d, r int, sustain float64) float64 {
+	level := sustain
+	switch {
+	case i < a:
+		level = float64(i) / float64(a)
+	case i < a+d:
+		t := float64(i-a) / float64(d)
+		level = 1.0 + t*(sustain-1.0)
+	}
+	if left := frames - i; left < r {
+		level *= float64(left) / float64(r)
+	}
+	return level
+}
+
+// oscillator returns one cycle of a wave, sampled at phase 0-1 advancing by
+// inc per sample. Square and saw are band-limited with PolyBLEP so high
+// notes do not alias.
+func oscillator(wave string, phase, inc, duty float64, noise func() float64) float64 {
+	switch wave {
+	case "square":
+		v := -1.0
+		if phase < duty {
+			v = 1
+		}
+		return v + polyBLEP(phase, inc) - polyBLEP(math.Mod(phase+1-duty, 1), inc)
+	case "saw":
+		return 2*phase - 1 - polyBLEP(phase, inc)
+	case "triangle":
+		return 1 - 4*math.Abs(phase-0.5)
+	case "noise":
+		return noise()
+	default: // sine, kick
+		return math.Sin(2 * math.Pi * phase)
+	}
+}
+
+// notePCM renders one note of freq Hz lasting frames samples, as
+// interleaved stereo. A detuned second oscillator is panned away from the
+// first by the instrument's Width.
+func notePCM(sampleRate int, in Instrument, freq float64, frames int, noise func() float64) []int16 {
+	pcm := make([]int16, frames*2)
+	ms := float64(sampleRate) / 1000
+	a, d, r := int(in.Attack*ms), int(in.Decay*ms), int(in.Release*ms)
+	// a short ramp at each end keeps even a hard-edged note from clicking
+	ramp := min(int(minRamp*float64(sampleRate)), frames/4)
+	a, r = max(a, ramp), max(r, ramp)
+	sustain := in.Sustain
+	if d == 0 && sustain == 0 {
+		sustain = 1
+	}
+	duty := in.Duty
+	if duty <= 0 || duty >= 1 {
+		duty = 0.5
+	}
+	width := max(0, min(1, in.Width))
+	detune := math.Pow(2, in.Detune/1200)
+	var p1, p2 float64
+	for i := 0; i < frames; i++ {
+		progress := float64(i) / float64(frames)
+		t := float64(i) / float64(sampleRate)
+		f := freq * math.Pow(2, (in.Slide*progress+in.Vibrato*math.Sin(2*math.Pi*in.VibratoHz*t))/12)
+		if in.Wave == "kick" {
+			// drop to a third of the pitch over the hit
+			f *= 1 - 2.0/3.0*progress
+		}
+		inc := f / float64(sampleRate)
+		left := oscillator(in.Wave, p1, inc, duty, noise)
+		right := left
+		if in.Detune != 0 {
+			s2 := oscillator(in.Wave, p2, inc*detune, duty, noise)
+			left, right = (left*(1+width)+s2*(1-width))/2, (left*(1-width)+s2*(1+width))/2
+			p2 = math.Mod(p2+f*detune/float64(sampleRate), 1)
+		}
+		p1 = math.Mod(p1+f/float64(sampleRate), 1)
+		level := in.Volume * envelope(i, frames, a, d, r, sustain) * 32767
+		pcm[i*2], pcm[i*2+1] = int16(left*level), int16(right*level)
+	}
+	return pcm
+}
+
+// newNoise returns a deterministic white noise source in -1..1.
+func newNoise(seed uint32) func() float64 {
+	rng := seed
+	return func() float64 { // simple LCG noise
+		rng = rng*1664525 + 1013904223
+		return float64(int16(rng>>16)) / 32768.0
+	}
+}
@@ -0,0 +1,137 @@
+package bgapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sentinel errors for the failure classes callers usually branch on. An
+// *Error matches the sentinel of its Kind via errors.Is.
+var (
+	ErrUnauthorized = errors.New("replicate: unauthorized")
+	ErrRateLimited  = errors.New("replicate: rate limited")
+	ErrNSFW         = errors.New("replicate: output flagged as NSFW")
+	ErrTimeout      = errors.New("replicate: prediction timed out")
+	ErrFailed       = errors.New("replicate: prediction failed")
+	ErrBadResponse  = errors.New("replicate: unexpected response")
+)
+
+// Error describes a failed call to the Replicate API.
+type Error struct {
+	Kind       error         // one of the sentinel errors above
+	StatusCode int           // HTTP status, 0 when the failure came from a prediction
+	Detail     string        // provider message, if any
+	RetryAfter time.Duration // server-suggested wait for rate limits and 5xx
+}
+
+func (e *Error) Error() string {
+	msg := e.Kind.Error()
+	if e.StatusCode != 0 {
+		msg += " (HTTP " + strconv.Itoa(e.StatusCode) + ")"
+	}
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error { return e.Kind }
+
+// apiError builds an *Error from a non-2xx response and its body.
+func apiError(resp *http.Response, body []byte) *Error {
+	e := &Error{StatusCode: resp.StatusCode, Detail: problemDetail(body), RetryAfter: retryAfter(resp.Header)}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		e.Kind = ErrUnauthorized
+	case resp.StatusCode == http.StatusTooManyRequests:
+		e.Kind = ErrRateLimited
+	default:
+		e.Kind = ErrBadResponse
+	}
+	return e
+}
+
+// predictionError classifies the error message of a failed prediction.
+func predictionError(msg string) *Error {
+	lower := strings.ToLower(msg)
+	if strings.Contains(lower, "nsfw") || strings.Contains(lower, "flagged") || strings.Contains(lower, "safety") {
+		return &Error{Kind: ErrNSFW, Detail: msg}
+	}
+	return &Error{Kind: ErrFailed, Detail: msg}
+}
+
+// problemDetail extracts the human-readable message from a Replicate error
+// body ({"detail": "..."} or {"error": "..."}), falling back to the raw text.
+func problemDetail(body []byte) string {
+	var p struct {
+		Detail string `json:"detail"`
+		Error  string `json:"error"`
+	}
+	if json.Unmarshal(body, &p) == nil {
+		if p.Detail != "" {
+			return p.Detail
+		}
+		if p.Error != "" {
+			return p.Error
+		}
+	}
+	s := strings.TrimSpace(string(body))
+	if len(s) > 200 {
+		s = s[:200]
+	}
+	return s
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// Retryable reports whether err is a transient provider failure worth retrying.
+func Retryable(err error) bool {
+	var e *Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.Kind == ErrRateLimited || e.StatusCode >= 500
+}
+
+// Class returns a short, stable label for err suitable for metrics.
+func Class(err error) string {
+	switch {
+	case err == nil:
+		return "none"
+	case errors.Is(err, ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrNSFW):
+		return "nsfw"
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, ErrFailed):
+		return "failed"
+	case errors.Is(err, ErrBadResponse):
+		return "bad_response"
+	}
+	return "other"
+}
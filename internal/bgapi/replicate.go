@@ -6,7 +6,10 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"log/slog"
 	"net/http"
+	"regexp"
+	"strconv"
 	"time"
 )
 
@@ -15,21 +18,140 @@ type Client struct {
 	Token string
 	Model string
 	Base  string
+	// Wait enables Replicate's synchronous mode (Prefer: wait=N, at most 60s):
+	// the create call blocks until the prediction finishes or the wait
+	// elapses, and polling only continues for slower predictions.
+	Wait time.Duration
+	// PollInterval is the first delay between status checks. It grows by half
+	// on every poll up to MaxPollInterval; a Retry-After from the server wins.
+	PollInterval    time.Duration
+	MaxPollInterval time.Duration
+	// Timeout bounds a generation whose context carries no deadline.
+	Timeout time.Duration
+	// Logger receives one debug record per API call, tagged with the
+	// request ID from the context (see WithRequestID). Nil uses slog.Default.
+	Logger *slog.Logger
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose API calls are logged with id and
+// sent upstream as X-Request-ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func (c *Client) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// Ping checks that the token is set and accepted by the API.
+func (c *Client) Ping(ctx context.Context) error {
+	if c.Token == "" {
+		return &Error{Kind: ErrUnauthorized, Detail: "missing replicate token"}
+	}
+	return c.callOnce(ctx, http.MethodGet, "/account", nil, nil)
 }
 
 func NewClient(token, model string) *Client {
 	return &Client{
-		HTTP:  &http.Client{Timeout: 60 * time.Second},
-		Token: token,
-		Model: model,
-		Base:  "https://api.replicate.com/v1",
+		HTTP:            &http.Client{Timeout: 90 * time.Second},
+		Token:           token,
+		Model:           model,
+		Base:            "https://api.replicate.com/v1",
+		PollInterval:    500 * time.Millisecond,
+		MaxPollInterval: 5 * time.Second,
+		Timeout:         2 * time.Minute,
 	}
 }
 
-// Generate requests an image and returns the first output image URL.
+// maxRetries bounds how often a single API call is retried on 429/5xx.
+const maxRetries = 4
+
+type prediction struct {
+	ID     string          `json:"id"`
+	Status string          `json:"status"`
+	Output json.RawMessage `json:"output"`
+	Error  json.RawMessage `json:"error"`
+	Logs   string          `json:"logs"`
+}
+
+func (p *prediction) done() bool {
+	return p.Status == "succeeded" || p.Status == "failed" || p.Status == "canceled"
+}
+
+// Input holds the model inputs for one prediction. Zero-valued optional
+// fields are left out so the model's own defaults apply.
+type Input struct {
+	Prompt         string
+	NegativePrompt string
+	Width, Height  int
+	Guidance       float64
+	Steps          int
+	Seed           int64
+	// Extra carries additional model-specific inputs verbatim.
+	Extra map[string]any
+}
+
+// DefaultInput returns the inputs Generate uses for a plain prompt.
+func DefaultInput(prompt string, width, height int) Input {
+	return Input{Prompt: prompt, Width: width, Height: height, Guidance: 3.5, Steps: 28}
+}
+
+func (in Input) params() map[string]any {
+	m := map[string]any{"prompt": in.Prompt}
+	for k, v := range in.Extra {
+		m[k] = v
+	}
+	if in.NegativePrompt != "" {
+		m["negative_prompt"] = in.NegativePrompt
+	}
+	if in.Width > 0 && in.Height > 0 {
+		m["width"] = in.Width
+		m["height"] = in.Height
+	}
+	if in.Guidance > 0 {
+		m["guidance"] = in.Guidance
+	}
+	if in.Steps > 0 {
+		m["num_inference_steps"] = in.Steps
+	}
+	if in.Seed != 0 {
+		m["seed"] = in.Seed
+	}
+	return m
+}
+
+// ProgressFunc receives the prediction status and an estimated completion
+// fraction in [0,1] each time the prediction is polled.
+type ProgressFunc func(status string, progress float64)
+
+// Generate requests an image with DefaultInput and returns the first output image URL.
 func (c *Client) Generate(ctx context.Context, prompt string, width, height int) (string, error) {
+	return c.Predict(ctx, DefaultInput(prompt, width, height), nil)
+}
+
+// Predict runs a prediction with the given inputs and returns the first
+// output image URL, reporting progress through the optional callback. If ctx
+// ends before the prediction finishes, the remote prediction is cancelled and
+// ErrTimeout (or ctx's cancellation error) is returned.
+func (c *Client) Predict(ctx context.Context, in Input, progress ProgressFunc) (string, error) {
 	if c.Token == "" {
-		return "", errors.New("missing replicate token")
+		return "", &Error{Kind: ErrUnauthorized, Detail: "missing replicate token"}
+	}
+	if _, ok := ctx.Deadline(); !ok && c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
 	}
 	model := c.Model
 	if model == "" {
@@ -37,66 +159,192 @@ func (c *Client) Generate(ctx context.Context, prompt string, width, height int)
 	}
 	body := map[string]any{
 		"model": model,
-		"input": map[string]any{
-			"prompt":              prompt,
-			"width":               width,
-			"height":              height,
-			"guidance":            3.5,
-			"num_inference_steps": 28,
-		},
+		"input": in.params(),
 	}
 	b, _ := json.Marshal(body)
-	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, c.Base+"/predictions", bytes.NewReader(b))
+	var p prediction
+	if err := c.call(ctx, http.MethodPost, "/predictions", b, &p); err != nil {
+		return "", c.abort(ctx, "", err)
+	}
+	report := func() {
+		if progress != nil {
+			progress(p.Status, estimateProgress(p.Status, p.Logs))
+		}
+	}
+	report()
+
+	delay := c.PollInterval
+	if delay <= 0 {
+		delay = 500 * time.Millisecond
+	}
+	for !p.done() {
+		if err := sleepCtx(ctx, delay); err != nil {
+			return "", c.abort(ctx, p.ID, err)
+		}
+		if err := c.call(ctx, http.MethodGet, "/predictions/"+p.ID, nil, &p); err != nil {
+			return "", c.abort(ctx, p.ID, err)
+		}
+		report()
+		delay += delay / 2
+		if c.MaxPollInterval > 0 && delay > c.MaxPollInterval {
+			delay = c.MaxPollInterval
+		}
+	}
+
+	switch p.Status {
+	case "failed":
+		var msg string
+		_ = json.Unmarshal(p.Error, &msg)
+		return "", predictionError(msg)
+	case "canceled":
+		return "", &Error{Kind: ErrFailed, Detail: "prediction was canceled"}
+	}
+	url, err := firstOutput(p.Output)
+	if err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+// call performs one API request, decoding a 2xx JSON body into out. Rate
+// limits and server errors are retried with exponential backoff, honouring
+// any Retry-After the server sends. Only GETs are retried on server errors:
+// a 5xx to a POST may come after the provider accepted it, and creating the
+// prediction again would bill it twice, whereas a 429 means it was refused.
+func (c *Client) call(ctx context.Context, method, path string, body []byte, out any) error {
+	delay := c.PollInterval
+	if delay <= 0 {
+		delay = 500 * time.Millisecond
+	}
+	for attempt := 0; ; attempt++ {
+		err := c.callOnce(ctx, method, path, body, out)
+		if err == nil || !Retryable(err) || attempt == maxRetries {
+			return err
+		}
+		if method != http.MethodGet && !errors.Is(err, ErrRateLimited) {
+			return err
+		}
+		wait := delay
+		var e *Error
+		if errors.As(err, &e) && e.RetryAfter > wait {
+			wait = e.RetryAfter
+		}
+		c.logger().WarnContext(ctx, "replicate call will be retried",
+			"request_id", RequestID(ctx), "method", method, "path", path, "error", err, "wait", wait)
+		if serr := sleepCtx(ctx, wait); serr != nil {
+			return serr
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) callOnce(ctx context.Context, method, path string, body []byte, out any) error {
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.Base+path, rd)
+	if err != nil {
+		return err
+	}
 	req.Header.Set("Authorization", "Token "+c.Token)
-	req.Header.Set("Content-Type", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	// only a create can wait for its prediction; other POSTs, such as a
+	// cancel, answer at once
+	if method == http.MethodPost && path == "/predictions" && c.Wait > 0 {
+		secs := int(c.Wait / time.Second)
+		secs = max(1, min(secs, 60))
+		req.Header.Set("Prefer", "wait="+strconv.Itoa(secs))
+	}
+	start := time.Now()
 	resp, err := c.HTTP.Do(req)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer resp.Body.Close()
+	c.logger().DebugContext(ctx, "replicate call", "request_id", RequestID(ctx),
+		"method", method, "path", path, "status", resp.StatusCode, "duration", time.Since(start))
 	if resp.StatusCode >= 300 {
-		x, _ := io.ReadAll(resp.Body)
-		return "", errors.New(string(x))
+		x, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return apiError(resp, x)
 	}
-	var p struct {
-		ID     string          `json:"id"`
-		Status string          `json:"status"`
-		Output json.RawMessage `json:"output"`
+	if out == nil {
+		return nil
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
-		return "", err
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return &Error{Kind: ErrBadResponse, StatusCode: resp.StatusCode, Detail: "decoding " + path + ": " + err.Error()}
 	}
+	return nil
+}
 
-	// Poll until completed
-	for i := 0; i < 40; i++ {
-		if p.Status == "succeeded" || p.Status == "failed" || p.Status == "canceled" {
-			break
-		}
-		time.Sleep(1500 * time.Millisecond)
-		rq, _ := http.NewRequestWithContext(ctx, http.MethodGet, c.Base+"/predictions/"+p.ID, nil)
-		rq.Header.Set("Authorization", "Token "+c.Token)
-		rs, err := c.HTTP.Do(rq)
-		if err != nil {
-			return "", err
-		}
-		var pr struct {
-			Status string          `json:"status"`
-			Output json.RawMessage `json:"output"`
-		}
-		_ = json.NewDecoder(rs.Body).Decode(&pr)
-		rs.Body.Close()
-		p.Status = pr.Status
-		p.Output = pr.Output
+// abort converts err into the error returned to the caller. If a prediction
+// was already created it is cancelled so it stops consuming credits, and an
+// expired deadline is reported as ErrTimeout.
+func (c *Client) abort(ctx context.Context, id string, err error) error {
+	if id != "" {
+		cctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		_ = c.callOnce(cctx, http.MethodPost, "/predictions/"+id+"/cancel", nil, nil)
+		cancel()
+	}
+	if ctx.Err() == nil {
+		return err
 	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &Error{Kind: ErrTimeout, Detail: "prediction " + id + " did not finish in time"}
+	}
+	return ctx.Err()
+}
 
-	if p.Status != "succeeded" {
-		return "", errors.New("replicate did not succeed: " + p.Status)
+// firstOutput returns the first image URL from a prediction output, which is
+// either a single URL or an array of URLs depending on the model.
+func firstOutput(raw json.RawMessage) (string, error) {
+	var url string
+	if json.Unmarshal(raw, &url) == nil && url != "" {
+		return url, nil
 	}
-	// Output is typically an array of URLs
 	var urls []string
-	_ = json.Unmarshal(p.Output, &urls)
-	if len(urls) == 0 {
-		return "", errors.New("no output images")
+	if err := json.Unmarshal(raw, &urls); err != nil {
+		return "", &Error{Kind: ErrBadResponse, Detail: "decoding output: " + err.Error()}
+	}
+	if len(urls) == 0 || urls[0] == "" {
+		return "", &Error{Kind: ErrBadResponse, Detail: "no output images"}
 	}
 	return urls[0], nil
 }
+
+// sleepCtx waits for d or until ctx ends, whichever comes first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+var percentRe = regexp.MustCompile(`(\d{1,3})%\|`)
+
+// estimateProgress derives a completion fraction from the prediction status
+// and, when the model emits tqdm-style logs (" 50%|█████ | 14/28"), the last
+// reported percentage.
+func estimateProgress(status, logs string) float64 {
+	switch status {
+	case "succeeded", "failed", "canceled":
+		return 1
+	case "starting":
+		return 0.05
+	}
+	if m := percentRe.FindAllStringSubmatch(logs, -1); len(m) > 0 {
+		if pct, err := strconv.Atoi(m[len(m)-1][1]); err == nil && pct <= 100 {
+			return 0.1 + 0.85*float64(pct)/100
+		}
+	}
+	return 0.1
+}
@@ -0,0 +1,243 @@
+package bgapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeReplicate is an httptest stand-in for the Replicate API. handle
+// answers each request; every request is recorded.
+type fakeReplicate struct {
+	mu     sync.Mutex
+	calls  []string                                            // "METHOD /path"
+	prefer []string                                            // Prefer header of each call
+	handle func(w http.ResponseWriter, r *http.Request, n int) // n counts calls to the same method and path
+}
+
+func (f *fakeReplicate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	call := r.Method + " " + r.URL.Path
+	n := 0
+	for _, c := range f.calls {
+		if c == call {
+			n++
+		}
+	}
+	f.calls = append(f.calls, call)
+	f.prefer = append(f.prefer, r.Header.Get("Prefer"))
+	f.mu.Unlock()
+	f.handle(w, r, n)
+}
+
+func (f *fakeReplicate) count(call string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.calls {
+		if c == call {
+			n++
+		}
+	}
+	return n
+}
+
+func newFake(t *testing.T, handle func(w http.ResponseWriter, r *http.Request, n int)) (*fakeReplicate, *Client) {
+	t.Helper()
+	f := &fakeReplicate{handle: handle}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	c := NewClient("token", "owner/model")
+	c.Base = srv.URL
+	c.PollInterval = time.Millisecond
+	c.MaxPollInterval = 5 * time.Millisecond
+	c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return f, c
+}
+
+func reply(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+}
+
+const (
+	starting  = `{"id": "p1", "status": "starting"}`
+	succeeded = `{"id": "p1", "status": "succeeded", "output": ["https://example.com/out.png"]}`
+)
+
+func TestPollRetriesServerErrors(t *testing.T) {
+	f, c := newFake(t, func(w http.ResponseWriter, r *http.Request, n int) {
+		switch {
+		case r.Method == http.MethodPost:
+			reply(w, http.StatusCreated, starting)
+		case n < 2:
+			reply(w, http.StatusServiceUnavailable, `{"detail": "try later"}`)
+		default:
+			reply(w, http.StatusOK, succeeded)
+		}
+	})
+	url, err := c.Predict(context.Background(), DefaultInput("a forest", 64, 64), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "https://example.com/out.png" {
+		t.Errorf("url = %q", url)
+	}
+	if got := f.count("GET /predictions/p1"); got != 3 {
+		t.Errorf("polled %d times, want 3 (two 503s, then success)", got)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	f, c := newFake(t, func(w http.ResponseWriter, r *http.Request, n int) {
+		if r.Method == http.MethodPost && n == 0 {
+			w.Header().Set("Retry-After", "1")
+			reply(w, http.StatusTooManyRequests, `{"detail": "slow down"}`)
+			return
+		}
+		reply(w, http.StatusCreated, succeeded)
+	})
+	start := time.Now()
+	if _, err := c.Predict(context.Background(), DefaultInput("a forest", 64, 64), nil); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("retried after %v, want the 1s Retry-After", d)
+	}
+	if got := f.count("POST /predictions"); got != 2 {
+		t.Errorf("created %d times, want 2", got)
+	}
+}
+
+func TestCreateNotRetriedOnServerError(t *testing.T) {
+	f, c := newFake(t, func(w http.ResponseWriter, r *http.Request, n int) {
+		reply(w, http.StatusBadGateway, `{"detail": "upstream"}`)
+	})
+	_, err := c.Predict(context.Background(), DefaultInput("a forest", 64, 64), nil)
+	if !errors.Is(err, ErrBadResponse) {
+		t.Fatalf("err = %v, want ErrBadResponse", err)
+	}
+	if got := f.count("POST /predictions"); got != 1 {
+		t.Errorf("created %d times, want 1: a retried create may be billed twice", got)
+	}
+}
+
+func TestRateLimitGivesUp(t *testing.T) {
+	f, c := newFake(t, func(w http.ResponseWriter, r *http.Request, n int) {
+		reply(w, http.StatusTooManyRequests, `{"detail": "slow down"}`)
+	})
+	_, err := c.Predict(context.Background(), DefaultInput("a forest", 64, 64), nil)
+	if !errors.Is(err, ErrRateLimited) || Class(err) != "rate_limited" {
+		t.Fatalf("err = %v (class %s), want ErrRateLimited", err, Class(err))
+	}
+	if got := f.count("POST /predictions"); got != maxRetries+1 {
+		t.Errorf("tried %d times, want %d", got, maxRetries+1)
+	}
+}
+
+func TestPreferWait(t *testing.T) {
+	f, c := newFake(t, func(w http.ResponseWriter, r *http.Request, n int) {
+		if r.Method == http.MethodPost {
+			reply(w, http.StatusCreated, starting)
+			return
+		}
+		reply(w, http.StatusOK, succeeded)
+	})
+	c.Wait = 90 * time.Second
+	if _, err := c.Predict(context.Background(), DefaultInput("a forest", 64, 64), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.prefer) != 2 {
+		t.Fatalf("%d calls, want 2", len(f.prefer))
+	}
+	if f.prefer[0] != "wait=60" {
+		t.Errorf("create sent Prefer %q, want wait=60 (capped)", f.prefer[0])
+	}
+	if f.prefer[1] != "" {
+		t.Errorf("poll sent Prefer %q, want none", f.prefer[1])
+	}
+}
+
+func TestTimeoutCancelsPrediction(t *testing.T) {
+	f, c := newFake(t, func(w http.ResponseWriter, r *http.Request, n int) {
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/cancel"):
+			reply(w, http.StatusOK, `{"id": "p1", "status": "canceled"}`)
+		case r.Method == http.MethodPost:
+			reply(w, http.StatusCreated, starting)
+		default:
+			reply(w, http.StatusOK, `{"id": "p1", "status": "processing"}`)
+		}
+	})
+	c.Wait = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := c.Predict(ctx, DefaultInput("a forest", 64, 64), nil)
+	if !errors.Is(err, ErrTimeout) || Class(err) != "timeout" {
+		t.Fatalf("err = %v (class %s), want ErrTimeout", err, Class(err))
+	}
+	if got := f.count("POST /predictions/p1/cancel"); got != 1 {
+		t.Errorf("cancelled %d times, want 1", got)
+	}
+	for i, call := range f.calls {
+		if call == "POST /predictions/p1/cancel" && f.prefer[i] != "" {
+			t.Errorf("cancel sent Prefer %q, want none", f.prefer[i])
+		}
+	}
+}
+
+func TestErrorClasses(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		want   error
+		class  string
+	}{
+		{"unauthorized", http.StatusUnauthorized, `{"detail": "bad token"}`, ErrUnauthorized, "unauthorized"},
+		{"forbidden", http.StatusForbidden, `{"detail": "no access"}`, ErrUnauthorized, "unauthorized"},
+		{"nsfw", http.StatusCreated, `{"id": "p1", "status": "failed", "error": "NSFW content detected"}`, ErrNSFW, "nsfw"},
+		{"failed", http.StatusCreated, `{"id": "p1", "status": "failed", "error": "CUDA out of memory"}`, ErrFailed, "failed"},
+		{"canceled", http.StatusCreated, `{"id": "p1", "status": "canceled"}`, ErrFailed, "failed"},
+		{"garbage", http.StatusCreated, `not json`, ErrBadResponse, "bad_response"},
+		{"no output", http.StatusCreated, `{"id": "p1", "status": "succeeded", "output": []}`, ErrBadResponse, "bad_response"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, c := newFake(t, func(w http.ResponseWriter, r *http.Request, n int) {
+				reply(w, tc.status, tc.body)
+			})
+			_, err := c.Predict(context.Background(), DefaultInput("a forest", 64, 64), nil)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("err = %v, want %v", err, tc.want)
+			}
+			if got := Class(err); got != tc.class {
+				t.Errorf("Class = %q, want %q", got, tc.class)
+			}
+		})
+	}
+	if got := Class(nil); got != "none" {
+		t.Errorf("Class(nil) = %q", got)
+	}
+	if got := Class(fmt.Errorf("wrapped: %w", context.Canceled)); got != "canceled" {
+		t.Errorf("Class(canceled) = %q", got)
+	}
+}
+
+func TestMissingToken(t *testing.T) {
+	_, c := newFake(t, func(w http.ResponseWriter, r *http.Request, n int) {
+		t.Error("no request should be made without a token")
+	})
+	c.Token = ""
+	if _, err := c.Predict(context.Background(), DefaultInput("a forest", 64, 64), nil); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("err = %v, want ErrUnauthorized", err)
+	}
+}
@@ -0,0 +1,108 @@
+package bgservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Client talks to a bgserver.
+type Client struct {
+	HTTP *http.Client
+	// Endpoint is the URL of POST /api/background; jobs are polled below it.
+	Endpoint string
+	// Token, if set, is sent as a bearer credential.
+	Token        string
+	PollInterval time.Duration
+}
+
+func NewClient(endpoint, token string) *Client {
+	return &Client{
+		HTTP:         &http.Client{Timeout: 30 * time.Second},
+		Endpoint:     endpoint,
+		Token:        token,
+		PollInterval: time.Second,
+	}
+}
+
+// StatusError is returned when the server answers with a non-2xx status.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("bgserver: %s", http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("bgserver: %d: %s", e.StatusCode, e.Message)
+}
+
+// Create submits a generation job. Requests answered from the server's
+// pre-generated pool come back already succeeded.
+func (c *Client) Create(ctx context.Context, req Request) (Job, error) {
+	var job Job
+	err := c.do(ctx, http.MethodPost, c.Endpoint, req, &job)
+	return job, err
+}
+
+// Job fetches the current state of a job.
+func (c *Client) Job(ctx context.Context, id string) (Job, error) {
+	var job Job
+	err := c.do(ctx, http.MethodGet, c.Endpoint+"/"+id, nil, &job)
+	return job, err
+}
+
+// Generate submits req and polls until the job finishes or ctx ends. A
+// failed job is returned together with an error carrying its message.
+func (c *Client) Generate(ctx context.Context, req Request) (Job, error) {
+	job, err := c.Create(ctx, req)
+	for err == nil && !job.Status.Done() {
+		select {
+		case <-ctx.Done():
+			return job, ctx.Err()
+		case <-time.After(c.PollInterval):
+		}
+		job, err = c.Job(ctx, job.ID)
+	}
+	if err == nil && job.Status == StatusFailed {
+		err = fmt.Errorf("bgserver: job %s failed: %s", job.ID, job.Error)
+	}
+	return job, err
+}
+
+func (c *Client) do(ctx context.Context, method, url string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	rq, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		rq.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		rq.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(rq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e ErrorResponse
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+		return &StatusError{StatusCode: resp.StatusCode, Message: e.Error}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
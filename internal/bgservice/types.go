@@ -0,0 +1,83 @@
+package bgservice
+
+import (
+	_ "embed"
+	"time"
+)
+
+// OpenAPI is the OpenAPI 3 description of the background API, served by
+// bgserver at /openapi.json. Keep it in step with the types below.
+//
+//go:embed openapi.json
+var OpenAPI []byte
+
+// Request asks for a background. Prompt may be empty when Style names a
+// prompt template; zero model parameters take the template's.
+type Request struct {
+	Prompt string `json:"prompt"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// Template selection; used when Prompt is empty.
+	Style     string `json:"style,omitempty"`
+	Biome     string `json:"biome,omitempty"`
+	TimeOfDay string `json:"timeOfDay,omitempty"`
+	// Model parameters.
+	NegativePrompt string  `json:"negativePrompt,omitempty"`
+	Guidance       float64 `json:"guidance,omitempty"`
+	Steps          int     `json:"steps,omitempty"`
+	Seed           int64   `json:"seed,omitempty"`
+	// Post-processing.
+	Format     string  `json:"format,omitempty"` // jpeg (default) or png
+	Quality    int     `json:"quality,omitempty"`
+	Look       string  `json:"look,omitempty"` // "limbo" presets the filters below
+	Desaturate float64 `json:"desaturate,omitempty"`
+	Darken     float64 `json:"darken,omitempty"`
+	Vignette   float64 `json:"vignette,omitempty"`
+}
+
+type JobStatus string
+
+const (
+	StatusQueued    JobStatus = "queued"
+	StatusRunning   JobStatus = "running"
+	StatusSucceeded JobStatus = "succeeded"
+	StatusFailed    JobStatus = "failed"
+)
+
+// Done reports whether the job has finished, successfully or not.
+func (s JobStatus) Done() bool { return s == StatusSucceeded || s == StatusFailed }
+
+// Job is a generation as reported by the API.
+type Job struct {
+	ID        string    `json:"id"`
+	Status    JobStatus `json:"status"`
+	Progress  float64   `json:"progress"`
+	URL       string    `json:"url,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Background is one pre-generated image as listed by /api/backgrounds.
+type Background struct {
+	Hash      string    `json:"hash"`
+	Style     string    `json:"style"`
+	Prompt    string    `json:"prompt"`
+	Seed      int64     `json:"seed"`
+	CreatedAt time.Time `json:"createdAt"`
+	Served    int       `json:"served"`
+	Pinned    bool      `json:"pinned"`
+	Banned    bool      `json:"banned"`
+	URL       string    `json:"url,omitempty"` // empty once banned
+}
+
+// Mark is the body of PATCH /api/backgrounds/{hash}.
+type Mark struct {
+	Pinned *bool `json:"pinned,omitempty"`
+	Banned *bool `json:"banned,omitempty"`
+}
+
+// ErrorResponse is the body of every JSON error response.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
@@ -12,43 +12,49 @@ type cachedItem struct {
 	expiresAt time.Time
 }
 
+// Key identifies a cached leaderboard query.
+type Key struct {
+	Limit      int
+	Difficulty string
+}
+
 type TopWinnersCache struct {
 	mu    sync.RWMutex
-	items map[int]cachedItem // keyed by limit
+	items map[Key]cachedItem
 	ttl   time.Duration
 }
 
 func NewTopWinnersCache(ttl time.Duration) *TopWinnersCache {
 	return &TopWinnersCache{
-		items: make(map[int]cachedItem),
+		items: make(map[Key]cachedItem),
 		ttl:   ttl,
 	}
 }
 
-func (c *TopWinnersCache) Get(limit int) ([]model.Winner, bool) {
+func (c *TopWinnersCache) Get(key Key) ([]model.Winner, bool) {
 	c.mu.RLock()
-	item, ok := c.items[limit]
+	item, ok := c.items[key]
 	c.mu.RUnlock()
 	if !ok {
 		return nil, false
 	}
 	if time.Now().After(item.expiresAt) {
 		c.mu.Lock()
-		delete(c.items, limit)
+		delete(c.items, key)
 		c.mu.Unlock()
 		return nil, false
 	}
 	return item.winners, true
 }
 
-func (c *TopWinnersCache) Set(limit int, winners []model.Winner) {
+func (c *TopWinnersCache) Set(key Key, winners []model.Winner) {
 	c.mu.Lock()
-	c.items[limit] = cachedItem{winners: winners, expiresAt: time.Now().Add(c.ttl)}
+	c.items[key] = cachedItem{winners: winners, expiresAt: time.Now().Add(c.ttl)}
 	c.mu.Unlock()
 }
 
 func (c *TopWinnersCache) InvalidateAll() {
 	c.mu.Lock()
-	c.items = make(map[int]cachedItem)
+	c.items = make(map[Key]cachedItem)
 	c.mu.Unlock()
 }
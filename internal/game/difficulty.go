@@ -0,0 +1,83 @@
+package game
+
+import (
+	"strings"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/inpututil"
+
+	"github.com/stoneresearch/dimalimbo/internal/settings"
+)
+
+// SetProfileLoader lets the title screen switch settings profiles; load
+// resolves the settings for a profile name ("" for the base settings).
+func (g *Game) SetProfileLoader(load func(profile string) SettingsUpdate) { g.loadProfile = load }
+
+// updateTitleSelect handles the difficulty and profile pickers on the title
+// screen: left/right cycle the presets, P cycles the profiles.
+func (g *Game) updateTitleSelect() {
+	step := 0
+	if inpututil.IsKeyJustPressed(ebiten.KeyArrowRight) || inpututil.IsGamepadButtonJustPressed(0, ebiten.GamepadButton15) {
+		step = 1
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyArrowLeft) || inpututil.IsGamepadButtonJustPressed(0, ebiten.GamepadButton14) {
+		step = -1
+	}
+	if step != 0 {
+		g.cycleDifficulty(step)
+	}
+	if inpututil.IsKeyJustPressed(ebiten.KeyP) && g.loadProfile != nil {
+		g.cycleProfile()
+	}
+}
+
+func (g *Game) cycleDifficulty(step int) {
+	names := settings.PresetNames
+	i := indexOf(names, g.cfg.PresetName())
+	if i < 0 {
+		// custom tuning: start from normal
+		i = indexOf(names, "normal") - step
+	}
+	i = (i + step + len(names)) % len(names)
+	_ = g.cfg.ApplyPreset(names[i])
+	g.pending = nil
+	g.refreshLeaders()
+	g.showToast("Difficulty: " + strings.ToUpper(names[i]))
+}
+
+func (g *Game) cycleProfile() {
+	names := append([]string{""}, g.cfg.ProfileNames()...)
+	name := names[(indexOf(names, g.cfg.Profile)+1)%len(names)]
+	u := g.loadProfile(name)
+	if u.Err != nil {
+		g.showToast("Profile not loaded: " + u.Err.Error())
+		return
+	}
+	msg := "Profile: " + profileLabel(name)
+	if err := g.applySettings(u.Settings); err != nil {
+		msg += " (" + err.Error() + ")"
+	}
+	g.refreshLeaders()
+	g.showToast(msg)
+}
+
+// refreshLeaders reloads the leaderboard for the current difficulty.
+func (g *Game) refreshLeaders() {
+	g.leaders, _ = g.store.TopWinners(g.cfg.TopN, g.cfg.PresetName())
+}
+
+func profileLabel(name string) string {
+	if name == "" {
+		return "default"
+	}
+	return name
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -2,8 +2,11 @@ package game
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"fmt"
 	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
 	"math"
 	"math/rand"
@@ -23,6 +26,7 @@ import (
 
 	"github.com/stoneresearch/dimalimbo/internal/assets"
 	aud "github.com/stoneresearch/dimalimbo/internal/audio"
+	"github.com/stoneresearch/dimalimbo/internal/bgservice"
 	"github.com/stoneresearch/dimalimbo/internal/model"
 	"github.com/stoneresearch/dimalimbo/internal/settings"
 	"github.com/stoneresearch/dimalimbo/internal/storage"
@@ -31,6 +35,8 @@ import (
 const (
 	screenWidth  = 800
 	screenHeight = 600
+
+	whooshLead = 0.6 // seconds before an obstacle reaches the player that its whoosh starts
 )
 
 type GameState int
@@ -64,6 +70,7 @@ type Game struct {
 	nameInput string
 	leaders   []model.Winner
 	seeded    bool
+	seed      int64 // fixed RNG seed; 0 seeds from the clock
 	// visuals/audio
 	offscreen *ebiten.Image
 	bgImage   *ebiten.Image
@@ -84,7 +91,15 @@ type Game struct {
 	speed      float64
 	spawnEvery int
 	// settings
-	cfg settings.Settings
+	cfg     settings.Settings
+	updates <-chan SettingsUpdate
+	bgURL   <-chan string      // URL of the background generated at launch
+	pending *settings.Settings // reloaded difficulty, applied at the next run
+	// loadProfile resolves the settings of a named profile
+	loadProfile func(profile string) SettingsUpdate
+	// toast
+	toast       string
+	toastFrames int
 	// fonts
 	titleFace font.Face
 	uiFace    font.Face
@@ -131,6 +146,13 @@ func New(store *storage.Storage, cfg settings.Settings) *Game {
 	}
 	if g.audio != nil {
 		g.audio.SetStyle(cfg.MusicStyle)
+		if err := g.audio.SetPlaylist(playlist(cfg)); err != nil {
+			g.showToast("Music: " + err.Error())
+		}
+		applyMixer(g.audio, cfg)
+		if err := g.audio.SetEffectsFile(cfg.SFXFile); err != nil {
+			g.showToast("Sound effects: " + err.Error())
+		}
 	}
 	// init parallax stars
 	for i := 0; i < 64; i++ {
@@ -163,69 +185,176 @@ func New(store *storage.Storage, cfg settings.Settings) *Game {
 
 func (g *Game) spawnObstacle() {
 	height := 40 + rand.Intn(140)
-	y := rand.Intn(screenHeight - height)
+	g.addObstacle(float64(rand.Intn(screenHeight-height)), float64(height))
+}
+
+// addObstacle adds an obstacle at the right edge of the screen.
+func (g *Game) addObstacle(y, height float64) {
 	g.obstacles = append(g.obstacles, rectangle{
 		x: screenWidth,
-		y: float64(y),
+		y: y,
 		w: 20,
-		h: float64(height),
+		h: height,
 	})
 }
 
+// timeOfDay names the part of the day for t, used to pick the lighting of
+// generated backgrounds.
+func timeOfDay(t time.Time) string {
+	switch h := t.Hour(); {
+	case h >= 5 && h < 10:
+		return "dawn"
+	case h >= 10 && h < 17:
+		return "overcast day"
+	case h >= 17 && h < 21:
+		return "dusk"
+	default:
+		return "night"
+	}
+}
+
+// SetSeed makes runs reproducible by seeding the RNG with seed instead of
+// the clock. It must be called before the first Update.
+func (g *Game) SetSeed(seed int64) { g.seed = seed }
+
+// SetMode picks the screen the game starts on: "title", "play" or "leaderboard".
+func (g *Game) SetMode(mode string) error {
+	switch mode {
+	case "", "title":
+		g.state = stateTitle
+	case "play":
+		g.startRun()
+	case "leaderboard":
+		g.state = stateLeaderboard
+	default:
+		return fmt.Errorf("unknown mode %q (want title, play or leaderboard)", mode)
+	}
+	return nil
+}
+
+// startRun begins a run and its music, which rhythm mode spawns obstacles
+// to.
+func (g *Game) startRun() {
+	g.resetPlay()
+	g.state = statePlaying
+	if g.audio != nil && g.cfg.MusicEnabled {
+		g.audio.PlayStart()
+		g.audio.PlayMusic()
+		g.audio.SetIntensity(g.musicIntensity())
+	}
+}
+
 func (g *Game) resetPlay() {
+	g.applyDifficulty()
 	g.player = rectangle{x: 60, y: screenHeight/2 - 20, w: 30, h: 30}
 	g.obstacles = g.obstacles[:0]
 	g.score = 0
 	g.frames = 0
-	g.speed = 4
-	g.spawnEvery = 60
+	g.speed = g.cfg.BaseSpeed
+	g.spawnEvery = g.cfg.SpawnEveryStart
+}
+
+// musicIntensity rises from 0.35 at the start of a run to 1 once the
+// obstacles move twice as fast as they started.
+func (g *Game) musicIntensity() float64 {
+	if g.cfg.BaseSpeed <= 0 {
+		return 1
+	}
+	return 0.35 + 0.65*(g.speed-g.cfg.BaseSpeed)/g.cfg.BaseSpeed
+}
+
+// playAt plays a sound placed at (x, y) and moving vx, vy pixels per frame.
+func (g *Game) playAt(name string, x, y, vx, vy float64) {
+	if g.audio == nil {
+		return
+	}
+	tps := float64(ebiten.TPS())
+	g.audio.PlayAt(name, aud.Source{X: x, Y: y, VX: vx * tps, VY: vy * tps})
+}
+
+// nearMiss reports whether obstacle o, having moved dx, just passed the
+// player's back edge within a few pixels without touching.
+func nearMiss(p, o rectangle, dx float64) bool {
+	if o.x+o.w > p.x || o.x+o.w+dx <= p.x {
+		return false
+	}
+	gap := math.Max(o.y-(p.y+p.h), p.y-(o.y+o.h))
+	return gap >= 0 && gap < 16
 }
 
 func (g *Game) Update() error {
 	if !g.seeded {
-		rand.Seed(time.Now().UnixNano())
+		if g.seed == 0 {
+			g.seed = time.Now().UnixNano()
+		}
+		rand.Seed(g.seed)
 		g.seeded = true
-		g.leaders, _ = g.store.TopWinners(g.cfg.TopN)
-		// auto-fetch background if endpoint provided
+		g.refreshLeaders()
+		// auto-fetch background if endpoint provided; the URL is applied
+		// below once it arrives
 		if g.cfg.BackgroundURL == "" && g.cfg.BackgroundEndpoint != "" {
-			go func(ep string) {
-				req := map[string]any{"prompt": "colorful adventurous synthwave space, cinematic, detailed", "width": 1600, "height": 900}
-				b, _ := json.Marshal(req)
-				resp, err := http.Post(ep, "application/json", bytes.NewReader(b))
-				if err == nil && resp.StatusCode < 300 {
-					var r struct {
-						URL string `json:"url"`
-					}
-					_ = json.NewDecoder(resp.Body).Decode(&r)
-					resp.Body.Close()
-					if r.URL != "" {
-						g.cfg.BackgroundURL = r.URL
-					}
+			urls := make(chan string, 1)
+			g.bgURL = urls
+			client := bgservice.NewClient(g.cfg.BackgroundEndpoint, g.cfg.BackgroundToken)
+			req := bgservice.Request{
+				Style:     g.cfg.BackgroundStyle,
+				TimeOfDay: timeOfDay(time.Now()),
+				Width:     1600,
+				Height:    900,
+				Format:    "jpeg",
+			}
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+				defer cancel()
+				if job, err := client.Generate(ctx, req); err == nil {
+					urls <- job.URL
 				}
-			}(g.cfg.BackgroundEndpoint)
+			}()
 		}
 	}
 
+	g.pollSettings()
+	select {
+	case url := <-g.bgURL:
+		g.cfg.BackgroundURL = url
+		g.bgURL = nil
+	default:
+	}
+	if g.toastFrames > 0 {
+		g.toastFrames--
+	}
+
 	// fullscreen toggle
 	if inpututil.IsKeyJustPressed(ebiten.KeyF) {
 		ebiten.SetFullscreen(!ebiten.IsFullscreen())
 	}
 	// mute toggle
 	if inpututil.IsKeyJustPressed(ebiten.KeyM) {
+		g.cfg.Muted = !g.cfg.Muted
 		if g.audio != nil {
-			g.audio.ToggleMute()
+			g.audio.SetBusMuted(aud.Master, g.cfg.Muted)
 		}
 	}
+	// next track of the player's own music (N is a letter when typing a name)
+	if inpututil.IsKeyJustPressed(ebiten.KeyN) && g.state != stateNameEntry && g.audio != nil {
+		g.audio.NextTrack()
+	}
+
+	if g.audio != nil {
+		g.audio.SetListener(g.player.x+g.player.w*0.5, g.player.y+g.player.h*0.5)
+	}
 
 	// occasional shooting stars
 	if rand.Intn(120) == 0 {
-		g.shooters = append(g.shooters, shootingStar{
+		s := shootingStar{
 			x:    float64(screenWidth + 20),
 			y:    float64(40 + rand.Intn(160)),
 			vx:   -3.2 - rand.Float64()*2.0,
 			vy:   0.7 + rand.Float64()*0.6,
 			life: 160,
-		})
+		}
+		g.shooters = append(g.shooters, s)
+		g.playAt("shootingStar", s.x, s.y, s.vx, s.vy)
 	}
 	aliveS := g.shooters[:0]
 	for _, s := range g.shooters {
@@ -240,14 +369,16 @@ func (g *Game) Update() error {
 
 	// spawn satellites (parallax foreground)
 	if rand.Intn(180) == 0 {
-		g.satellites = append(g.satellites, satellite{
+		s := satellite{
 			x:     float64(screenWidth + 40),
 			y:     float64(40 + rand.Intn(screenHeight/2)),
 			spin:  rand.Float64() * math.Pi,
 			vel:   0.9 + rand.Float64()*0.6,
 			size:  10 + rand.Float64()*10,
 			glowA: 160,
-		})
+		}
+		g.satellites = append(g.satellites, s)
+		g.playAt("satellite", s.x, s.y, -s.vel, 0)
 	}
 	aliveSat := g.satellites[:0]
 	for _, s := range g.satellites {
@@ -261,13 +392,9 @@ func (g *Game) Update() error {
 
 	switch g.state {
 	case stateTitle:
+		g.updateTitleSelect()
 		if inpututil.IsKeyJustPressed(ebiten.KeySpace) || inpututil.IsMouseButtonJustPressed(ebiten.MouseButtonLeft) || len(ebiten.TouchIDs()) > 0 || inpututil.IsGamepadButtonJustPressed(0, ebiten.GamepadButton0) {
-			g.resetPlay()
-			g.state = statePlaying
-			if g.audio != nil && g.cfg.MusicEnabled {
-				g.audio.PlayStart()
-				g.audio.PlayMusic()
-			}
+			g.startRun()
 		}
 	case statePlaying:
 		// Player movement
@@ -319,7 +446,11 @@ func (g *Game) Update() error {
 		}
 
 		// dynamic spawn frequency and speed increase
-		if g.frames%g.spawnEvery == 0 {
+		if steps, ok := g.rhythmSteps(); ok {
+			for _, s := range steps {
+				g.spawnOnStep(s)
+			}
+		} else if g.frames%g.spawnEvery == 0 {
 			g.spawnObstacle()
 		}
 		if g.frames%g.cfg.AccelIntervalFrames == 0 {
@@ -328,6 +459,9 @@ func (g *Game) Update() error {
 			}
 			g.speed += g.cfg.SpeedAccel
 		}
+		if g.audio != nil {
+			g.audio.SetIntensity(g.musicIntensity())
+		}
 
 		// particles update (neon trail)
 		aliveP := g.particles[:0]
@@ -359,7 +493,11 @@ func (g *Game) Update() error {
 
 		// move obstacles and detect collision
 		alive := g.obstacles[:0]
+		ahead := g.player.x + g.player.w + g.speed*float64(ebiten.TPS())*whooshLead
 		for _, o := range g.obstacles {
+			if o.x > ahead && o.x-g.speed <= ahead {
+				g.playAt("obstacle", o.x+o.w*0.5, o.y+o.h*0.5, -g.speed, 0)
+			}
 			o.x -= g.speed
 			if o.x+o.w > 0 {
 				alive = append(alive, o)
@@ -369,9 +507,13 @@ func (g *Game) Update() error {
 				g.nameInput = ""
 				if g.audio != nil {
 					g.audio.PlayHit()
+					g.audio.SetIntensity(0)
 				}
 				return nil
 			}
+			if g.audio != nil && nearMiss(g.player, o, g.speed) {
+				g.audio.NearMiss()
+			}
 		}
 		g.obstacles = alive
 
@@ -397,8 +539,8 @@ func (g *Game) Update() error {
 			if name == "" {
 				name = "PLAYER"
 			}
-			_ = g.store.SaveWinner(name, g.score)
-			g.leaders, _ = g.store.TopWinners(g.cfg.TopN)
+			_ = g.store.SaveWinner(name, g.score, g.cfg.PresetName())
+			g.refreshLeaders()
 			g.state = stateLeaderboard
 			if g.audio != nil {
 				g.audio.PlaySubmit()
@@ -407,7 +549,7 @@ func (g *Game) Update() error {
 	case stateLeaderboard:
 		if inpututil.IsKeyJustPressed(ebiten.KeyR) {
 			_ = g.store.Reset()
-			g.leaders, _ = g.store.TopWinners(g.cfg.TopN)
+			g.refreshLeaders()
 		}
 		if inpututil.IsKeyJustPressed(ebiten.KeySpace) || inpututil.IsGamepadButtonJustPressed(0, ebiten.GamepadButton0) {
 			g.state = stateTitle
@@ -614,6 +756,7 @@ func (g *Game) Draw(screen *ebiten.Image) {
 	case stateLeaderboard:
 		drawLeaderboardUI(g, screen)
 	}
+	drawToast(g, screen)
 }
 
 func (g *Game) Layout(outsideWidth, outsideHeight int) (int, int) {
@@ -683,6 +826,14 @@ func drawTitleUI(g *Game, dst *ebiten.Image) {
 	promptWidth := len(prompt) * 6
 	promptX := centerX - promptWidth/2
 	text.Draw(dst, prompt, basicfont.Face7x13, promptX, titleY+120, color.RGBA{160, 160, 160, 180})
+
+	// Difficulty and profile pickers
+	difficulty := "<  " + strings.ToUpper(g.cfg.PresetName()) + "  >"
+	text.Draw(dst, difficulty, basicfont.Face7x13, centerX-len(difficulty)*7/2, titleY+160, color.RGBA{140, 140, 140, 200})
+	if len(g.cfg.Profiles) > 0 {
+		profile := "Profile: " + profileLabel(g.cfg.Profile) + "  (P to change)"
+		text.Draw(dst, profile, basicfont.Face7x13, centerX-len(profile)*7/2, titleY+185, color.RGBA{100, 100, 100, 180})
+	}
 }
 
 func drawHUDUI(g *Game, dst *ebiten.Image) {
@@ -752,7 +903,7 @@ func drawLeaderboardUI(g *Game, dst *ebiten.Image) {
 	startY := 120
 
 	// LIMBO-style leaderboard - properly centered
-	title := "Those who traveled far"
+	title := "Those who traveled far - " + strings.ToUpper(g.cfg.PresetName())
 	titleWidth := len(title) * 8
 	text.Draw(dst, title, face, centerX-titleWidth/2, startY, color.RGBA{160, 160, 160, 255})
 
@@ -0,0 +1,169 @@
+package game
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"strings"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
+	"github.com/hajimehoshi/ebiten/v2/text"
+	"golang.org/x/image/font/basicfont"
+
+	aud "github.com/stoneresearch/dimalimbo/internal/audio"
+	"github.com/stoneresearch/dimalimbo/internal/settings"
+)
+
+// SettingsUpdate is a reloaded configuration. Err means the file could not
+// be used and Settings is ignored; Warn means it was used with adjustments.
+type SettingsUpdate struct {
+	Settings settings.Settings
+	Warn     error
+	Err      error
+}
+
+// WatchSettings makes the game apply updates received on ch while it runs.
+func (g *Game) WatchSettings(ch <-chan SettingsUpdate) { g.updates = ch }
+
+// pollSettings applies a pending settings update; called from Update.
+func (g *Game) pollSettings() {
+	select {
+	case u, ok := <-g.updates:
+		if !ok {
+			g.updates = nil
+			return
+		}
+		if u.Err != nil {
+			g.showToast("Settings not reloaded: " + u.Err.Error())
+			return
+		}
+		if warn := errors.Join(u.Warn, g.applySettings(u.Settings)); warn != nil {
+			g.showToast("Settings reloaded: " + warn.Error())
+		} else {
+			g.showToast("Settings reloaded")
+		}
+	default:
+	}
+}
+
+// applySettings takes over the fields that are safe to change while the
+// game runs. Difficulty changes wait for the next run; window, storage,
+// input and font settings need a restart. The error reports sound effects
+// or music that could not be loaded.
+func (g *Game) applySettings(s settings.Settings) error {
+	var err error
+	if g.audio != nil {
+		applyMixer(g.audio, s)
+		g.audio.SetStyle(s.MusicStyle)
+		if sfxErr := g.audio.SetEffectsFile(s.SFXFile); sfxErr != nil {
+			err = fmt.Errorf("sound effects: %w", sfxErr)
+		}
+		if p, was := playlist(s), playlist(g.cfg); (p == nil) != (was == nil) || p != nil && *p != *was {
+			if musicErr := g.audio.SetPlaylist(p); musicErr != nil {
+				err = errors.Join(err, fmt.Errorf("music: %w", musicErr))
+			}
+		}
+		if s.MusicEnabled != g.cfg.MusicEnabled {
+			if s.MusicEnabled && g.state == statePlaying {
+				g.audio.PlayMusic()
+			} else if !s.MusicEnabled {
+				g.audio.StopMusic()
+			}
+		}
+	}
+	g.shaderOn = s.PostFXEnabled
+	g.shaderInt = float32(s.ShaderIntensity)
+
+	c := &g.cfg
+	c.MasterVolume = s.MasterVolume
+	c.MusicVolume, c.SFXVolume, c.UIVolume = s.MusicVolume, s.SFXVolume, s.UIVolume
+	c.Reverb = s.Reverb
+	c.Muted, c.MusicMuted, c.SFXMuted, c.UIMuted = s.Muted, s.MusicMuted, s.SFXMuted, s.UIMuted
+	c.SFXFile = s.SFXFile
+	c.MusicStyle = s.MusicStyle
+	c.MusicEnabled = s.MusicEnabled
+	c.MusicSource, c.MusicDir, c.MusicShuffle = s.MusicSource, s.MusicDir, s.MusicShuffle
+	c.MusicRepeat, c.MusicCrossfade = s.MusicRepeat, s.MusicCrossfade
+	c.ShaderIntensity = s.ShaderIntensity
+	c.PostFXEnabled = s.PostFXEnabled
+	c.RenderScale = s.RenderScale
+	c.LowPower = s.LowPower
+	c.ShowGrid = s.ShowGrid
+	c.BackgroundStyle = s.BackgroundStyle
+	c.Profile = s.Profile
+	c.Profiles = s.Profiles
+
+	g.pending = &s
+	// a finished run is still recorded under the difficulty it was played on
+	if g.state == stateTitle || g.state == stateLeaderboard {
+		g.applyDifficulty()
+		g.refreshLeaders()
+	}
+	return err
+}
+
+// playlist is the player's own music s asks for, or nil for the generated
+// songs.
+func playlist(s settings.Settings) *aud.Playlist {
+	if s.MusicSource != "user" {
+		return nil
+	}
+	return &aud.Playlist{Dir: s.MusicDir, Shuffle: s.MusicShuffle, Repeat: s.MusicRepeat, Crossfade: s.MusicCrossfade}
+}
+
+// applyMixer sets the audio buses and reverb from s.
+func applyMixer(a *aud.Manager, s settings.Settings) {
+	a.SetBusVolume(aud.Master, s.MasterVolume)
+	a.SetBusVolume(aud.Music, s.MusicVolume)
+	a.SetBusVolume(aud.SFX, s.SFXVolume)
+	a.SetBusVolume(aud.UI, s.UIVolume)
+	a.SetBusMuted(aud.Master, s.Muted)
+	a.SetBusMuted(aud.Music, s.MusicMuted)
+	a.SetBusMuted(aud.SFX, s.SFXMuted)
+	a.SetBusMuted(aud.UI, s.UIMuted)
+	a.SetReverb(s.Reverb)
+}
+
+// applyDifficulty takes over pending difficulty settings.
+func (g *Game) applyDifficulty() {
+	if g.pending == nil {
+		return
+	}
+	s, c := g.pending, &g.cfg
+	c.BaseSpeed = s.BaseSpeed
+	c.SpawnEveryStart = s.SpawnEveryStart
+	c.SpawnEveryMin = s.SpawnEveryMin
+	c.SpeedAccel = s.SpeedAccel
+	c.AccelIntervalFrames = s.AccelIntervalFrames
+	c.Rhythm = s.Rhythm
+	c.Difficulty = s.Difficulty
+	g.pending = nil
+}
+
+func (g *Game) showToast(msg string) {
+	// multi-line errors are summarised by their first line
+	if first, _, more := strings.Cut(msg, "\n"); more {
+		msg = first + " (+more)"
+	}
+	if len(msg) > 100 {
+		msg = msg[:97] + "..."
+	}
+	g.toast = msg
+	g.toastFrames = 240
+}
+
+func drawToast(g *Game, dst *ebiten.Image) {
+	if g.toastFrames <= 0 {
+		return
+	}
+	alpha := uint8(220)
+	if g.toastFrames < 30 {
+		alpha = uint8(g.toastFrames * 220 / 30)
+	}
+	w := len(g.toast)*7 + 24
+	x := (screenWidth - w) / 2
+	y := screenHeight - 44
+	ebitenutil.DrawRect(dst, float64(x), float64(y), float64(w), 26, color.RGBA{10, 10, 14, alpha})
+	text.Draw(dst, g.toast, basicfont.Face7x13, x+12, y+17, color.RGBA{170, 170, 170, alpha})
+}
@@ -0,0 +1,71 @@
+package game
+
+import (
+	"math"
+
+	"github.com/hajimehoshi/ebiten/v2"
+
+	aud "github.com/stoneresearch/dimalimbo/internal/audio"
+)
+
+// In rhythm mode obstacles spawn on the beats of the generated music, and
+// the notes of its sequencer patterns place them.
+const (
+	lowNote       = 65.41  // Hz (C2) of a note placed at the bottom of the screen
+	highNote      = 1046.5 // Hz (C6) of one placed at the top
+	maxSpawnBeats = 8      // longest wait between obstacles, in beats
+)
+
+// rhythmSteps returns the music steps heard since the last frame. It is
+// false when rhythm mode is off or no generated music plays, and obstacles
+// then spawn every spawnEvery frames instead.
+func (g *Game) rhythmSteps() ([]aud.Step, bool) {
+	if !g.cfg.Rhythm || g.audio == nil {
+		return nil, false
+	}
+	if _, ok := g.audio.Position(); !ok {
+		return nil, false
+	}
+	return g.audio.Steps(), true
+}
+
+// spawnOnStep spawns an obstacle if s is one of the beats due one: every
+// 1, 2, 4 or 8 beats, whichever comes closest to spawnEvery without being
+// more often, so the obstacles keep to the bar as the game speeds up. A
+// note starting on the beat places the obstacle, higher notes higher up,
+// and a longer note makes it taller; a beat without one places it at
+// random.
+func (g *Game) spawnOnStep(s aud.Step) {
+	if s.Tick != 0 {
+		return
+	}
+	beatFrames := 60 * float64(ebiten.TPS()) / s.Tempo
+	every := 1
+	for every < maxSpawnBeats && float64(every*2)*beatFrames <= float64(g.spawnEvery) {
+		every *= 2
+	}
+	if (s.Bar*s.BeatsPerBar+s.Beat)%every != 0 {
+		return
+	}
+	n, ok := melody(s.Notes)
+	if !ok {
+		g.spawnObstacle()
+		return
+	}
+	height := float64(40 + min(140, n.Len*10))
+	pitch := math.Log2(n.Freq/lowNote) / math.Log2(highNote/lowNote)
+	g.addObstacle((1-max(0, min(1, pitch)))*(screenHeight-height), height)
+}
+
+// melody picks the note that leads at a step: the lead's, else the bass's,
+// else the pad's. Drums carry no tune and are left out.
+func melody(notes []aud.Onset) (aud.Onset, bool) {
+	for _, layer := range []string{"lead", "bass", "pad"} {
+		for _, n := range notes {
+			if n.Layer == layer && n.Freq > 0 {
+				return n, true
+			}
+		}
+	}
+	return aud.Onset{}, false
+}
@@ -3,8 +3,9 @@ package model
 import "time"
 
 type Winner struct {
-	ID        int64
-	Name      string
-	Score     int
-	CreatedAt time.Time
+	ID         int64
+	Name       string
+	Score      int
+	CreatedAt  time.Time
+	Difficulty string // preset the run was played on, or "custom"
 }
@@ -0,0 +1,180 @@
+package paths
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+const app = "dimalimbo"
+
+// PortableMarker is the file that, placed next to the executable, turns on
+// portable mode.
+const PortableMarker = "portable"
+
+// Dirs are where the game keeps its files.
+type Dirs struct {
+	Config   string // settings.json
+	Data     string // leaderboard database
+	Cache    string // disposable downloads
+	Exe      string // the executable's directory
+	Work     string // the working directory at startup
+	Portable bool   // everything lives next to the executable
+}
+
+// Resolve returns the per-user directories: os.UserConfigDir and
+// os.UserCacheDir, and $XDG_DATA_HOME (default ~/.local/share) for data on
+// Linux and other Unixes. Portable mode, chosen by the portable argument,
+// DIMALIMBO_PORTABLE or a PortableMarker file beside the executable, keeps
+// everything in the executable's directory instead. Directories that cannot
+// be determined fall back to the working directory.
+func Resolve(portable bool) Dirs {
+	exeDir, workDir := ".", "."
+	if exe, err := os.Executable(); err == nil {
+		exeDir = filepath.Dir(exe)
+	}
+	if wd, err := os.Getwd(); err == nil {
+		workDir = wd
+	}
+	if !portable {
+		portable, _ = strconv.ParseBool(os.Getenv("DIMALIMBO_PORTABLE"))
+	}
+	if !portable {
+		_, err := os.Stat(filepath.Join(exeDir, PortableMarker))
+		portable = err == nil
+	}
+	if portable {
+		return Dirs{Config: exeDir, Data: exeDir, Cache: filepath.Join(exeDir, "cache"), Exe: exeDir, Work: workDir, Portable: true}
+	}
+
+	d := Dirs{Config: ".", Data: ".", Cache: ".", Exe: exeDir, Work: workDir}
+	if base, err := os.UserConfigDir(); err == nil {
+		d.Config = filepath.Join(base, app)
+	}
+	if base, err := os.UserCacheDir(); err == nil {
+		d.Cache = filepath.Join(base, app)
+	}
+	if base, err := dataHome(); err == nil {
+		d.Data = filepath.Join(base, app)
+	}
+	return d
+}
+
+func dataHome() (string, error) {
+	switch runtime.GOOS {
+	case "windows", "darwin", "ios", "plan9", "js":
+		// no separate data location; keep data beside the config
+		return os.UserConfigDir()
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share"), nil
+}
+
+// Settings is the default settings file.
+func (d Dirs) Settings() string { return filepath.Join(d.Config, "settings.json") }
+
+// DB is the default leaderboard database.
+func (d Dirs) DB() string { return filepath.Join(d.Data, "dimalimbo.db") }
+
+// Legacy returns where older versions may have left a file called name:
+// the working directory, which they wrote to, and the executable's
+// directory, which they were usually started from.
+func (d Dirs) Legacy(name string) []string {
+	srcs := []string{filepath.Join(d.Work, name)}
+	if filepath.Clean(d.Exe) != filepath.Clean(d.Work) {
+		srcs = append(srcs, filepath.Join(d.Exe, name))
+	}
+	return srcs
+}
+
+// Ensure creates the directories.
+func (d Dirs) Ensure() error {
+	for _, dir := range []string{d.Config, d.Data, d.Cache} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A Move relocates a file left behind by an older version.
+type Move struct {
+	Src, Dst string
+	// Check, if set, must accept the file before it moves, so that an
+	// unrelated file that merely shares the name stays where it is.
+	Check func() bool
+}
+
+// Migrate moves files left behind by older versions to their new
+// locations. Every source is checked before anything moves; sources that
+// are missing or fail their Check are skipped, and so are those whose
+// destination exists by their turn, so the first source for a destination
+// wins. It returns a line per moved file.
+func Migrate(moves []Move) ([]string, error) {
+	var todo []Move
+	for _, m := range moves {
+		if _, err := os.Stat(m.Src); err != nil {
+			continue
+		}
+		if m.Check == nil || m.Check() {
+			todo = append(todo, m)
+		}
+	}
+	var done []string
+	var errs []error
+	for _, m := range todo {
+		src, dst := m.Src, m.Dst
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if err := move(src, dst); err != nil {
+			errs = append(errs, fmt.Errorf("moving %s: %w", src, err))
+			continue
+		}
+		done = append(done, fmt.Sprintf("%s -> %s", src, dst))
+	}
+	return done, errors.Join(errs...)
+}
+
+// move renames src to dst, copying across file systems when it must.
+func move(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	if err := os.Remove(src); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package paths
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// chdir changes into dir for the rest of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func writeFile(t *testing.T, path, body string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// TestMigrateFromWorkingDir moves the files an older version wrote to the
+// directory it was started from, such as a source checkout under go run,
+// where the executable lives somewhere else entirely.
+func TestMigrateFromWorkingDir(t *testing.T) {
+	t.Setenv("DIMALIMBO_PORTABLE", "")
+	work, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, work)
+	writeFile(t, "settings.json", `{"musicVolume": 0.9}`)
+	writeFile(t, "dimalimbo.db", "leaderboard")
+	writeFile(t, "dimalimbo.db-journal", "journal")
+
+	d := Resolve(false)
+	if d.Work != work {
+		t.Fatalf("Work = %q, want %q", d.Work, work)
+	}
+	home := t.TempDir()
+	d.Config, d.Data = filepath.Join(home, "config"), filepath.Join(home, "data")
+	if got := d.Legacy("settings.json"); got[0] != filepath.Join(work, "settings.json") {
+		t.Fatalf("Legacy = %q, want the working directory first", got)
+	}
+	var moves []Move
+	for _, src := range d.Legacy("settings.json") {
+		moves = append(moves, Move{Src: src, Dst: d.Settings()})
+	}
+	for _, db := range d.Legacy("dimalimbo.db") {
+		// the journal is checked against its database, which moves first
+		check := func() bool { return exists(db) }
+		for _, suffix := range []string{"", "-journal"} {
+			moves = append(moves, Move{Src: db + suffix, Dst: d.DB() + suffix, Check: check})
+		}
+	}
+	moved, err := Migrate(moves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 3 {
+		t.Errorf("moved %q, want settings, database and journal", moved)
+	}
+	if got := readFile(t, d.Settings()); got != `{"musicVolume": 0.9}` {
+		t.Errorf("settings = %q", got)
+	}
+	if got := readFile(t, d.DB()+"-journal"); got != "journal" {
+		t.Errorf("journal = %q", got)
+	}
+	for _, name := range []string{"settings.json", "dimalimbo.db", "dimalimbo.db-journal"} {
+		if exists(filepath.Join(work, name)) {
+			t.Errorf("%s was left in the working directory", name)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	work, exe, dst := filepath.Join(dir, "work"), filepath.Join(dir, "exe"), filepath.Join(dir, "new", "settings.json")
+	for _, d := range []string{work, exe} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(work, "settings.json"), "not ours")
+	writeFile(t, filepath.Join(exe, "settings.json"), "ours")
+	writeFile(t, filepath.Join(work, "other.json"), "ours too")
+	ours := func(path string) func() bool {
+		return func() bool { return strings.HasPrefix(readFile(t, path), "ours") }
+	}
+	moved, err := Migrate([]Move{
+		{Src: filepath.Join(work, "missing.json"), Dst: dst},
+		{Src: filepath.Join(work, "settings.json"), Dst: dst, Check: ours(filepath.Join(work, "settings.json"))},
+		{Src: filepath.Join(exe, "settings.json"), Dst: dst, Check: ours(filepath.Join(exe, "settings.json"))},
+		{Src: filepath.Join(work, "other.json"), Dst: dst, Check: ours(filepath.Join(work, "other.json"))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rejected file stays, the first accepted one wins and the later
+	// one finds its destination taken
+	if !slices.Equal(moved, []string{filepath.Join(exe, "settings.json") + " -> " + dst}) {
+		t.Errorf("moved %q", moved)
+	}
+	if got := readFile(t, dst); got != "ours" {
+		t.Errorf("moved %q", got)
+	}
+	if !exists(filepath.Join(work, "settings.json")) || !exists(filepath.Join(work, "other.json")) {
+		t.Error("a rejected or late file was moved")
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	d := Dirs{Work: "/game", Exe: "/game/"}
+	if got := d.Legacy("settings.json"); len(got) != 1 {
+		t.Errorf("Legacy = %q, want the shared directory once", got)
+	}
+	d.Exe = "/opt/game"
+	if got := d.Legacy("settings.json"); !slices.Equal(got, []string{filepath.Join("/game", "settings.json"), filepath.Join("/opt/game", "settings.json")}) {
+		t.Errorf("Legacy = %q, want the working directory, then the executable's", got)
+	}
+}
@@ -0,0 +1,158 @@
+package prompts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// Template describes how to prompt the image model for one background style.
+// Prompt and NegativePrompt are text/template strings over Vars.
+type Template struct {
+	Prompt         string  `json:"prompt"`
+	NegativePrompt string  `json:"negativePrompt,omitempty"`
+	Biome          string  `json:"biome,omitempty"`     // default {{.Biome}}
+	TimeOfDay      string  `json:"timeOfDay,omitempty"` // default {{.TimeOfDay}}
+	Guidance       float64 `json:"guidance,omitempty"`
+	Steps          int     `json:"steps,omitempty"`
+	Look           string  `json:"look,omitempty"` // server-side post-processing preset
+}
+
+// Vars are the values substituted into a template.
+type Vars struct {
+	Biome     string
+	TimeOfDay string
+	Seed      int64
+}
+
+// Rendered is a template resolved for a concrete request.
+type Rendered struct {
+	Prompt         string
+	NegativePrompt string
+	Guidance       float64
+	Steps          int
+	Seed           int64
+	Look           string
+}
+
+// Set holds templates keyed by background style. The "default" entry is
+// used for styles without a template of their own.
+type Set map[string]Template
+
+const limboNegative = "color, saturated, bright, text, watermark, logo, people in focus, cartoon"
+
+// Defaults returns the built-in templates for the game's background styles.
+func Defaults() Set {
+	return Set{
+		"default": {
+			Prompt:         "pitch-black {{.Biome}} silhouettes at {{.TimeOfDay}}, thick fog, monochrome film grain, side-scrolling game background, cinematic, variation {{.Seed}}",
+			NegativePrompt: limboNegative,
+			Biome:          "wasteland",
+			TimeOfDay:      "dusk",
+			Guidance:       3.5,
+			Steps:          28,
+			Look:           "limbo",
+		},
+		"limbo_forest": {
+			Prompt:         "dark {{.Biome}} of twisted trees and hanging vines in silhouette at {{.TimeOfDay}}, glowing fog between layers, monochrome, LIMBO-like side-scrolling game background, variation {{.Seed}}",
+			NegativePrompt: limboNegative,
+			Biome:          "forest",
+			TimeOfDay:      "dusk",
+			Guidance:       3.5,
+			Steps:          28,
+			Look:           "limbo",
+		},
+		"limbo_industrial": {
+			Prompt:         "abandoned {{.Biome}} with smokestacks, gears and pipes in silhouette at {{.TimeOfDay}}, dense haze, monochrome, LIMBO-like side-scrolling game background, variation {{.Seed}}",
+			NegativePrompt: limboNegative,
+			Biome:          "factory",
+			TimeOfDay:      "night",
+			Guidance:       4,
+			Steps:          28,
+			Look:           "limbo",
+		},
+		"synthwave": {
+			Prompt:   "colorful adventurous synthwave {{.Biome}} at {{.TimeOfDay}}, neon grid horizon, cinematic, detailed, variation {{.Seed}}",
+			Biome:    "space",
+			Guidance: 3.5,
+			Steps:    28,
+		},
+	}
+}
+
+// Load reads a JSON object of style templates from path and layers it over
+// Defaults, so a file only needs the styles it changes. Each template is
+// rendered once with its own defaults, so a broken prompt or negative
+// prompt, or one that comes out empty, is reported here rather than on the
+// first request for it.
+func Load(path string) (Set, error) {
+	s := Defaults()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	var file Set
+	if err := json.Unmarshal(b, &file); err != nil {
+		return s, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for style, t := range file {
+		r, err := Set{style: t}.Render(style, Vars{})
+		if err != nil {
+			return s, err
+		}
+		if strings.TrimSpace(r.Prompt) == "" {
+			return s, fmt.Errorf("style %q: prompt is empty", style)
+		}
+		s[style] = t
+	}
+	return s, nil
+}
+
+// Render resolves the template for style with v; empty vars fall back to the
+// template's own defaults.
+func (s Set) Render(style string, v Vars) (Rendered, error) {
+	t, ok := s[style]
+	if !ok {
+		t = s["default"]
+	}
+	if v.Biome == "" {
+		v.Biome = t.Biome
+	}
+	if v.TimeOfDay == "" {
+		v.TimeOfDay = t.TimeOfDay
+	}
+	prompt, err := execute(t.Prompt, v)
+	if err != nil {
+		return Rendered{}, fmt.Errorf("style %q: %w", style, err)
+	}
+	neg, err := execute(t.NegativePrompt, v)
+	if err != nil {
+		return Rendered{}, fmt.Errorf("style %q: %w", style, err)
+	}
+	return Rendered{
+		Prompt:         prompt,
+		NegativePrompt: neg,
+		Guidance:       t.Guidance,
+		Steps:          t.Steps,
+		Seed:           v.Seed,
+		Look:           t.Look,
+	}, nil
+}
+
+func execute(text string, v Vars) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	tpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, v); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
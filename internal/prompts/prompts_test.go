@@ -0,0 +1,44 @@
+package prompts
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name, file, err string
+	}{
+		{"ok", `{"cave": {"prompt": "a {{.Biome}} cave", "biome": "crystal"}}`, ""},
+		{"bad prompt", `{"cave": {"prompt": "a {{.Biome cave"}}`, `style "cave"`},
+		{"bad negative", `{"cave": {"prompt": "a cave", "negativePrompt": "{{.Colour}}"}}`, `style "cave"`},
+		{"empty prompt", `{"cave": {"negativePrompt": "blurry"}}`, "prompt is empty"},
+		{"blank prompt", `{"cave": {"prompt": "{{.Biome}}  "}}`, "prompt is empty"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "prompts.json")
+			if err := os.WriteFile(path, []byte(tc.file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			s, err := Load(path)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				r, err := s.Render("cave", Vars{})
+				if err != nil || r.Prompt != "a crystal cave" {
+					t.Errorf("Render = %q, %v", r.Prompt, err)
+				}
+				if _, ok := s["default"]; !ok {
+					t.Error("defaults were dropped")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("err = %v, want it to mention %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package settings
+
+import "fmt"
+
+// Tuning is the set of gameplay parameters a difficulty preset controls.
+type Tuning struct {
+	BaseSpeed           float64
+	SpawnEveryStart     int
+	SpawnEveryMin       int
+	SpeedAccel          float64
+	AccelIntervalFrames int
+}
+
+// PresetNames lists the difficulty presets from easiest to hardest.
+var PresetNames = []string{"easy", "normal", "hard", "insane"}
+
+// Presets maps a difficulty name to its tuning. "normal" matches Default.
+var Presets = map[string]Tuning{
+	"easy":   {BaseSpeed: 3, SpawnEveryStart: 75, SpawnEveryMin: 32, SpeedAccel: 0.3, AccelIntervalFrames: 420},
+	"normal": {BaseSpeed: 4, SpawnEveryStart: 60, SpawnEveryMin: 24, SpeedAccel: 0.4, AccelIntervalFrames: 300},
+	"hard":   {BaseSpeed: 5, SpawnEveryStart: 50, SpawnEveryMin: 18, SpeedAccel: 0.5, AccelIntervalFrames: 240},
+	"insane": {BaseSpeed: 6.5, SpawnEveryStart: 40, SpawnEveryMin: 12, SpeedAccel: 0.7, AccelIntervalFrames: 180},
+}
+
+// Tuning returns the gameplay parameters of s.
+func (s Settings) Tuning() Tuning {
+	return Tuning{
+		BaseSpeed:           s.BaseSpeed,
+		SpawnEveryStart:     s.SpawnEveryStart,
+		SpawnEveryMin:       s.SpawnEveryMin,
+		SpeedAccel:          s.SpeedAccel,
+		AccelIntervalFrames: s.AccelIntervalFrames,
+	}
+}
+
+// SetTuning sets the gameplay parameters of s.
+func (s *Settings) SetTuning(t Tuning) {
+	s.BaseSpeed = t.BaseSpeed
+	s.SpawnEveryStart = t.SpawnEveryStart
+	s.SpawnEveryMin = t.SpawnEveryMin
+	s.SpeedAccel = t.SpeedAccel
+	s.AccelIntervalFrames = t.AccelIntervalFrames
+}
+
+// ApplyPreset sets the tuning of the named difficulty preset.
+func (s *Settings) ApplyPreset(name string) error {
+	t, ok := Presets[name]
+	if !ok {
+		return fmt.Errorf("unknown difficulty %q (want easy, normal, hard or insane)", name)
+	}
+	s.SetTuning(t)
+	s.Difficulty = name
+	return nil
+}
+
+// PresetName names the preset the current tuning matches, or "custom".
+// Leaderboard entries are recorded under this name so only runs with the
+// same tuning are ranked against each other.
+func (s Settings) PresetName() string {
+	t := s.Tuning()
+	for _, name := range PresetNames {
+		if Presets[name] == t {
+			return name
+		}
+	}
+	return "custom"
+}
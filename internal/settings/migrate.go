@@ -0,0 +1,77 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// CurrentVersion is the settings.json schema written by Save.
+const CurrentVersion = 1
+
+// migrations[v] upgrades a file from version v to v+1. Files are migrated
+// as raw JSON objects so a step can rename keys or change their types
+// before the result is decoded into Settings. Append a step whenever a key
+// is renamed or re-typed and bump CurrentVersion.
+var migrations = []func(map[string]json.RawMessage) error{
+	// v0 files predate the version key; their keys already match v1.
+	0: func(map[string]json.RawMessage) error { return nil },
+}
+
+// migrate decodes b, upgrades it to CurrentVersion and returns the
+// resulting JSON along with the version it started from.
+func migrate(b []byte) ([]byte, int, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, 0, err
+	}
+	from := 0
+	if v, ok := raw["version"]; ok {
+		if err := json.Unmarshal(v, &from); err != nil {
+			return nil, 0, fmt.Errorf("version: %w", err)
+		}
+	}
+	if from < 0 {
+		return nil, from, fmt.Errorf("version %d is not a schema version", from)
+	}
+	if from > CurrentVersion {
+		return nil, from, fmt.Errorf("written by a newer version (schema %d, this build reads up to %d)", from, CurrentVersion)
+	}
+	if from == CurrentVersion {
+		return b, from, nil
+	}
+	for v := from; v < CurrentVersion; v++ {
+		if err := migrations[v](raw); err != nil {
+			return nil, from, fmt.Errorf("migrating from version %d: %w", v, err)
+		}
+	}
+	raw["version"] = json.RawMessage(fmt.Sprint(CurrentVersion))
+	out, err := json.Marshal(raw)
+	return out, from, err
+}
+
+// Recognize reports whether path holds a settings file of this game: a
+// JSON object with at least one key that names a setting. A file that
+// merely shares the name is not recognised.
+func Recognize(path string) bool {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return false
+	}
+	var s Settings
+	for key := range raw {
+		if s.has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// backup copies the pre-migration file next to path, e.g. settings.json.v0.bak.
+func backup(path string, b []byte, version int) error {
+	return os.WriteFile(fmt.Sprintf("%s.v%d.bak", path, version), b, 0o644)
+}
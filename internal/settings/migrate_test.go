@@ -0,0 +1,143 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file string
+		from int
+		err  string
+	}{
+		{"unversioned", `{"musicVolume": 0.9}`, 0, ""},
+		{"version 0", `{"version": 0, "musicVolume": 0.9}`, 0, ""},
+		{"current", `{"version": 1, "musicVolume": 0.9}`, 1, ""},
+		{"newer", `{"version": 2}`, 2, "newer version"},
+		{"negative", `{"version": -1}`, -1, "not a schema version"},
+		{"not a number", `{"version": "one"}`, 0, "version"},
+		{"not an object", `[1]`, 0, "cannot unmarshal"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, from, err := migrate([]byte(tc.file))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("err = %v, want it to mention %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil || from != tc.from {
+				t.Fatalf("from %d, err %v, want from %d", from, err, tc.from)
+			}
+			var s Settings
+			if err := json.Unmarshal(out, &s); err != nil {
+				t.Fatal(err)
+			}
+			if s.Version != CurrentVersion || s.MusicVolume != 0.9 {
+				t.Errorf("migrated to version %d with musicVolume %v", s.Version, s.MusicVolume)
+			}
+		})
+	}
+}
+
+// TestMigrationChain runs a v0 file through a stand-in migration that
+// renames a key, the kind of step a schema bump appends.
+func TestMigrationChain(t *testing.T) {
+	saved := migrations
+	t.Cleanup(func() { migrations = saved })
+	migrations = []func(map[string]json.RawMessage) error{
+		func(raw map[string]json.RawMessage) error {
+			raw["musicVolume"] = raw["volume"]
+			delete(raw, "volume")
+			return nil
+		},
+	}
+	out, from, err := migrate([]byte(`{"volume": 0.7}`))
+	if err != nil || from != 0 {
+		t.Fatalf("from %d, err %v", from, err)
+	}
+	if string(out) != `{"musicVolume":0.7,"version":1}` {
+		t.Errorf("migrated to %s", out)
+	}
+
+	migrations[0] = func(map[string]json.RawMessage) error { return errors.New("no") }
+	if _, _, err := migrate([]byte(`{}`)); err == nil || !strings.Contains(err.Error(), "migrating from version 0") {
+		t.Errorf("err = %v, want the failing step named", err)
+	}
+}
+
+func TestLoadMigrates(t *testing.T) {
+	const old = `{"musicVolume": 0.9, "palette": 2}`
+	path := writeFile(t, old)
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.MusicVolume != 0.9 || s.Palette != 2 || s.Version != CurrentVersion {
+		t.Errorf("loaded %+v", s)
+	}
+	if b, err := os.ReadFile(path + ".v0.bak"); err != nil || string(b) != old {
+		t.Errorf("backup = %q, %v, want the original file", b, err)
+	}
+	// the file is rewritten at the current version, so the next load
+	// neither migrates nor backs up again
+	if err := os.Remove(path + ".v0.bak"); err != nil {
+		t.Fatal(err)
+	}
+	again, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.MusicVolume != 0.9 || again.Palette != 2 {
+		t.Errorf("reloaded %+v", again)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(b), `"version": 1`) {
+		t.Errorf("rewritten file = %s, %v", b, err)
+	}
+	if _, err := os.Stat(path + ".v0.bak"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("backed up a current file again: %v", err)
+	}
+}
+
+// TestLoadBadVersion checks that a version no build ever wrote is treated
+// like a malformed file, and that a newer file is left alone.
+func TestLoadBadVersion(t *testing.T) {
+	for _, file := range []string{`{"version": -1}`, `{"version": 99, "musicVolume": 0.9}`} {
+		path := writeFile(t, file)
+		s, err := Load(path)
+		if !errors.Is(err, ErrUnusable) || s.MusicVolume != Default().MusicVolume {
+			t.Errorf("%s: err = %v, musicVolume %v, want the defaults", file, err, s.MusicVolume)
+		}
+		if b, _ := os.ReadFile(path); string(b) != file {
+			t.Errorf("%s was rewritten to %s", file, b)
+		}
+	}
+}
+
+func TestRecognize(t *testing.T) {
+	for _, tc := range []struct {
+		file string
+		want bool
+	}{
+		{`{"musicVolume": 0.9}`, true},
+		{`{"version": 1, "lowPower": true}`, true},
+		{`{"version": 1}`, false},
+		{`{"name": "some-package", "dependencies": {}}`, false},
+		{`[1, 2]`, false},
+		{`not json`, false},
+	} {
+		if got := Recognize(writeFile(t, tc.file)); got != tc.want {
+			t.Errorf("Recognize(%s) = %v, want %v", tc.file, got, tc.want)
+		}
+	}
+	if Recognize(filepath.Join(t.TempDir(), "settings.json")) {
+		t.Error("recognised a missing file")
+	}
+}
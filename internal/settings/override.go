@@ -0,0 +1,92 @@
+package settings
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix marks environment variables that override settings, e.g.
+// DIMALIMBO_MASTER_VOLUME=0.5 or DIMALIMBO_LOW_POWER=1.
+const EnvPrefix = "DIMALIMBO_"
+
+// fixed are keys that cannot be overridden one by one: the schema version
+// and profiles, which are chosen when loading (see LoadProfile).
+var fixed = map[string]bool{"version": true, "profile": true, "profiles": true}
+
+// Set assigns value to the field whose JSON key matches key. Keys are
+// compared ignoring case and underscores, so "masterVolume",
+// "master_volume" and "MASTER_VOLUME" all name the same field. Setting
+// "difficulty" applies the preset.
+func (s *Settings) Set(key, value string) error {
+	if normalizeKey(key) == "difficulty" {
+		return s.ApplyPreset(value)
+	}
+	v := reflect.ValueOf(s).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if normalizeKey(name) != normalizeKey(key) || fixed[name] {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a boolean", name, value)
+			}
+			f.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not an integer", name, value)
+			}
+			f.SetInt(int64(n))
+		case reflect.Float32, reflect.Float64:
+			x, err := strconv.ParseFloat(value, f.Type().Bits())
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a number", name, value)
+			}
+			f.SetFloat(x)
+		default:
+			return fmt.Errorf("%s cannot be set from a string", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown setting %q", key)
+}
+
+// ApplyEnv applies EnvPrefix variables from environ (as returned by
+// os.Environ). Variables that do not name a setting are ignored.
+func (s *Settings) ApplyEnv(environ []string) error {
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		key, ok := strings.CutPrefix(k, EnvPrefix)
+		if !ok || !s.has(key) {
+			continue
+		}
+		if err := s.Set(key, v); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+func (s *Settings) has(key string) bool {
+	t := reflect.TypeOf(*s)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if !fixed[name] && normalizeKey(name) == normalizeKey(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeKey(k string) string {
+	return strings.ToLower(strings.ReplaceAll(k, "_", ""))
+}
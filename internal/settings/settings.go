@@ -2,23 +2,43 @@ package settings
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"sort"
 )
 
 type Settings struct {
+	Version            int     `json:"version"` // schema version, see CurrentVersion
 	MasterVolume       float64 `json:"masterVolume"`
+	MusicVolume        float64 `json:"musicVolume"`
+	SFXVolume          float64 `json:"sfxVolume"`
+	UIVolume           float64 `json:"uiVolume"`
+	Reverb             float64 `json:"reverb"` // level of the shared reverb
+	Muted              bool    `json:"muted"`
+	MusicMuted         bool    `json:"musicMuted"`
+	SFXMuted           bool    `json:"sfxMuted"`
+	UIMuted            bool    `json:"uiMuted"`
+	SFXFile            string  `json:"sfxFile"` // custom sound effects, see audio.LoadEffects
 	ShaderIntensity    float32 `json:"shaderIntensity"`
 	Palette            int     `json:"palette"`
 	MusicStyle         string  `json:"musicStyle"`
 	MusicEnabled       bool    `json:"musicEnabled"`
+	MusicSource        string  `json:"musicSource"` // "generated" (musicStyle) or "user" (musicDir)
+	MusicDir           string  `json:"musicDir"`    // .ogg, .mp3 and .wav files; relative to the data dir
+	MusicShuffle       bool    `json:"musicShuffle"`
+	MusicRepeat        string  `json:"musicRepeat"`    // "all", "one" or "off"
+	MusicCrossfade     float64 `json:"musicCrossfade"` // seconds
 	BackgroundStyle    string  `json:"backgroundStyle"`
 	BackgroundURL      string  `json:"backgroundUrl"`
 	BackgroundEndpoint string  `json:"backgroundEndpoint"`
+	BackgroundToken    string  `json:"backgroundToken"`
 	ShowGrid           bool    `json:"showGrid"`
 	// Window/Perf
 	Fullscreen    bool    `json:"fullscreen"`
-	WindowWidth   int     `json:"windowWidth"`
-	WindowHeight  int     `json:"windowHeight"`
+	WindowWidth   int     `json:"windowWidth"`  // 0 leaves the size to the game
+	WindowHeight  int     `json:"windowHeight"` // 0 leaves the size to the game
 	UIScale       float64 `json:"uiScale"`
 	TargetFPS     int     `json:"targetFPS"`
 	PostFXEnabled bool    `json:"postFXEnabled"`
@@ -28,6 +48,7 @@ type Settings struct {
 	SpawnEveryMin       int     `json:"spawnEveryMin"`
 	SpeedAccel          float64 `json:"speedAccel"`
 	AccelIntervalFrames int     `json:"accelIntervalFrames"`
+	Rhythm              bool    `json:"rhythm"` // spawn obstacles on the beats of the music
 	// Input
 	EnableGamepad   bool    `json:"enableGamepad"`
 	GamepadDeadzone float64 `json:"gamepadDeadzone"`
@@ -39,18 +60,35 @@ type Settings struct {
 	// Performance
 	RenderScale float64 `json:"renderScale"`
 	LowPower    bool    `json:"lowPower"`
+	// Difficulty names a preset (see Presets) that overrides the gameplay
+	// values above; empty keeps them as they are.
+	Difficulty string `json:"difficulty,omitempty"`
+	// Profiles are named partial settings layered over the rest of the
+	// file; Profile selects one.
+	Profile  string                     `json:"profile,omitempty"`
+	Profiles map[string]json.RawMessage `json:"profiles,omitempty"`
 }
 
 func Default() Settings {
 	return Settings{
+		Version:             CurrentVersion,
 		MasterVolume:        0.25,
+		MusicVolume:         0.5,
+		SFXVolume:           1.0,
+		UIVolume:            0.8,
+		Reverb:              0.3,
 		ShaderIntensity:     0.7,
 		Palette:             0,
 		MusicStyle:          "synthwave",
 		MusicEnabled:        false,
+		MusicSource:         "generated",
+		MusicDir:            "music",
+		MusicRepeat:         "all",
+		MusicCrossfade:      3,
 		BackgroundStyle:     "limbo_forest", // LIMBO-inspired default
 		BackgroundURL:       "",
 		BackgroundEndpoint:  "",
+		BackgroundToken:     "",
 		ShowGrid:            false,
 		Fullscreen:          true,
 		WindowWidth:         1280,
@@ -74,20 +112,192 @@ func Default() Settings {
 	}
 }
 
-func Load(path string) Settings {
+// ErrUnusable marks Load errors for files that could not be used at all, in
+// which case the defaults are returned.
+var ErrUnusable = errors.New("settings file unusable, using defaults")
+
+// Load reads path on top of Default, so keys missing from the file keep
+// their defaults, and validates the result. A missing file is not an error.
+// Files from an older schema are migrated and rewritten, keeping a backup
+// of the original. The returned settings are always usable: a malformed
+// file yields the defaults and out-of-range values are clamped; the error
+// says what was ignored or adjusted.
+func Load(path string) (Settings, error) { return LoadProfile(path, "") }
+
+// LoadProfile is Load with the named profile layered over the file. An
+// empty profile uses the file's own "profile" key.
+func LoadProfile(path, profile string) (Settings, error) {
+	s := Default()
 	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if profile != "" {
+			return s, fmt.Errorf("%s: unknown profile %q", path, profile)
+		}
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("%w: %w", ErrUnusable, err)
+	}
+	migrated, from, err := migrate(b)
+	if err != nil {
+		return Default(), fmt.Errorf("%s: %w: %w", path, ErrUnusable, err)
+	}
+	if err := json.Unmarshal(migrated, &s); err != nil {
+		return Default(), fmt.Errorf("%s: %w: %w", path, ErrUnusable, err)
+	}
+	var errs []error
+	if from != CurrentVersion {
+		if err := backup(path, b, from); err != nil {
+			errs = append(errs, fmt.Errorf("backing up before migration: %w", err))
+		} else if err := Save(path, s); err != nil {
+			errs = append(errs, fmt.Errorf("saving migrated settings: %w", err))
+		}
+	}
+	s.applyDifficulty(&errs)
+	if profile == "" {
+		profile = s.Profile
+	}
+	if profile != "" {
+		if err := s.overlay(profile, &errs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := s.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return s, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// overlay applies the named profile's keys. A profile that sets gameplay
+// values without naming a difficulty leaves the file's preset behind.
+func (s *Settings) overlay(name string, errs *[]error) error {
+	raw, ok := s.Profiles[name]
+	if !ok {
+		s.Profile = ""
+		return fmt.Errorf("unknown profile %q", name)
+	}
+	profiles, difficulty, tuning := s.Profiles, s.Difficulty, s.Tuning()
+	s.Difficulty = ""
+	err := json.Unmarshal(raw, s)
+	s.Profile, s.Profiles = name, profiles
 	if err != nil {
-		return Default()
+		return fmt.Errorf("profile %q: %w", name, err)
 	}
-	var s Settings
-	if json.Unmarshal(b, &s) != nil {
-		return Default()
+	if s.Difficulty == "" && s.Tuning() == tuning {
+		s.Difficulty = difficulty
 	}
-	return s
+	s.applyDifficulty(errs)
+	return nil
 }
 
-func Save(path string, s Settings) {
-	_ = os.WriteFile(path, must(json.MarshalIndent(s, "", "  ")), 0o644)
+// applyDifficulty applies the named preset, dropping an unknown one.
+func (s *Settings) applyDifficulty(errs *[]error) {
+	if s.Difficulty == "" {
+		return
+	}
+	if err := s.ApplyPreset(s.Difficulty); err != nil {
+		*errs = append(*errs, err)
+		s.Difficulty = ""
+	}
 }
 
-func must(b []byte, _ error) []byte { return b }
+// ProfileNames lists the profiles defined in the file, sorted.
+func (s Settings) ProfileNames() []string {
+	names := make([]string, 0, len(s.Profiles))
+	for name := range s.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate clamps out-of-range values and resets invalid ones to their
+// defaults, returning one error per adjusted field.
+func (s *Settings) Validate() error {
+	d := Default()
+	var errs []error
+	clamp(&errs, "masterVolume", &s.MasterVolume, 0, 1)
+	clamp(&errs, "musicVolume", &s.MusicVolume, 0, 1)
+	clamp(&errs, "sfxVolume", &s.SFXVolume, 0, 1)
+	clamp(&errs, "uiVolume", &s.UIVolume, 0, 1)
+	clamp(&errs, "reverb", &s.Reverb, 0, 1)
+	clamp(&errs, "shaderIntensity", &s.ShaderIntensity, 0, 1)
+	if s.MusicStyle == "" {
+		errs = append(errs, fmt.Errorf("musicStyle is empty, using %q", d.MusicStyle))
+		s.MusicStyle = d.MusicStyle
+	}
+	if s.MusicSource != "generated" && s.MusicSource != "user" {
+		errs = append(errs, fmt.Errorf("musicSource %q is not generated or user, using %q", s.MusicSource, d.MusicSource))
+		s.MusicSource = d.MusicSource
+	}
+	if s.MusicRepeat != "all" && s.MusicRepeat != "one" && s.MusicRepeat != "off" {
+		errs = append(errs, fmt.Errorf("musicRepeat %q is not all, one or off, using %q", s.MusicRepeat, d.MusicRepeat))
+		s.MusicRepeat = d.MusicRepeat
+	}
+	clamp(&errs, "musicCrossfade", &s.MusicCrossfade, 0, 10)
+	if s.MusicDir == "" {
+		errs = append(errs, fmt.Errorf("musicDir is empty, using %q", d.MusicDir))
+		s.MusicDir = d.MusicDir
+	}
+	if s.BackgroundStyle == "" {
+		errs = append(errs, fmt.Errorf("backgroundStyle is empty, using %q", d.BackgroundStyle))
+		s.BackgroundStyle = d.BackgroundStyle
+	}
+	if s.WindowWidth != 0 {
+		clamp(&errs, "windowWidth", &s.WindowWidth, 320, 7680)
+	}
+	if s.WindowHeight != 0 {
+		clamp(&errs, "windowHeight", &s.WindowHeight, 240, 4320)
+	}
+	clamp(&errs, "uiScale", &s.UIScale, 0.5, 4)
+	clamp(&errs, "targetFPS", &s.TargetFPS, 15, 360)
+	clamp(&errs, "baseSpeed", &s.BaseSpeed, 1, 20)
+	clamp(&errs, "spawnEveryStart", &s.SpawnEveryStart, 5, 600)
+	clamp(&errs, "spawnEveryMin", &s.SpawnEveryMin, 5, s.SpawnEveryStart)
+	clamp(&errs, "speedAccel", &s.SpeedAccel, 0, 5)
+	clamp(&errs, "accelIntervalFrames", &s.AccelIntervalFrames, 1, 3600)
+	clamp(&errs, "gamepadDeadzone", &s.GamepadDeadzone, 0, 0.9)
+	clamp(&errs, "topN", &s.TopN, 1, 100)
+	clamp(&errs, "cacheTTLSeconds", &s.CacheTTLSeconds, 0, 3600)
+	if s.DBPath == "" {
+		errs = append(errs, fmt.Errorf("dbPath is empty, using %q", d.DBPath))
+		s.DBPath = d.DBPath
+	}
+	clamp(&errs, "renderScale", &s.RenderScale, 0.25, 2)
+	if _, ok := Presets[s.Difficulty]; s.Difficulty != "" && !ok {
+		errs = append(errs, fmt.Errorf("difficulty %q is not a preset, ignoring it", s.Difficulty))
+		s.Difficulty = ""
+	}
+	return errors.Join(errs...)
+}
+
+func clamp[T int | float32 | float64](errs *[]error, name string, v *T, lo, hi T) {
+	was := *v
+	switch {
+	case was < lo:
+		*v = lo
+	case was > hi:
+		*v = hi
+	default:
+		return
+	}
+	*errs = append(*errs, fmt.Errorf("%s %v is outside %v-%v, using %v", name, was, lo, hi, *v))
+}
+
+// Save writes s to path at the current schema version. The file is
+// replaced atomically so a crash cannot leave it half written.
+func Save(path string, s Settings) error {
+	s.Version = CurrentVersion
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,105 @@
+package settings
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFile writes body to settings.json in a fresh directory and returns
+// its path.
+func writeFile(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "settings.json")
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	d := Default()
+	for _, tc := range []struct {
+		name     string
+		file     string
+		want     func(s *Settings) // applied to the defaults
+		errs     []string          // fields the error must name
+		unusable bool
+	}{
+		{
+			name: "partial file keeps the other defaults",
+			file: `{"version": 1, "musicVolume": 0.9, "palette": 2}`,
+			want: func(s *Settings) { s.MusicVolume, s.Palette = 0.9, 2 },
+		},
+		{
+			name:     "malformed file",
+			file:     `{"version": 1, "musicVolume": `,
+			unusable: true,
+		},
+		{
+			name:     "wrong type",
+			file:     `{"version": 1, "musicVolume": "loud"}`,
+			unusable: true,
+		},
+		{
+			name: "out of range values are clamped",
+			file: `{"version": 1, "masterVolume": 3, "uiScale": 0.1, "targetFPS": 1000, "topN": 0, "spawnEveryMin": 90}`,
+			want: func(s *Settings) {
+				s.MasterVolume, s.UIScale, s.TargetFPS, s.TopN = 1, 0.5, 360, 1
+				s.SpawnEveryMin = s.SpawnEveryStart
+			},
+			errs: []string{"masterVolume 3", "uiScale 0.1", "targetFPS 1000", "topN 0", "spawnEveryMin 90"},
+		},
+		{
+			name: "invalid choices are reset",
+			file: `{"version": 1, "musicStyle": "", "musicRepeat": "twice", "difficulty": "brutal"}`,
+			errs: []string{"musicStyle", "musicRepeat", "brutal"},
+		},
+		{
+			name: "zero window size is left to the game",
+			file: `{"version": 1, "windowWidth": 0, "windowHeight": 0}`,
+			want: func(s *Settings) { s.WindowWidth, s.WindowHeight = 0, 0 },
+		},
+		{
+			name: "small window size is clamped",
+			file: `{"version": 1, "windowWidth": 100, "windowHeight": 100}`,
+			want: func(s *Settings) { s.WindowWidth, s.WindowHeight = 320, 240 },
+			errs: []string{"windowWidth 100", "windowHeight 100"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := Load(writeFile(t, tc.file))
+			if got := errors.Is(err, ErrUnusable); got != tc.unusable {
+				t.Errorf("err = %v, unusable %v, want %v", err, got, tc.unusable)
+			}
+			if tc.errs == nil && !tc.unusable && err != nil {
+				t.Errorf("err = %v, want none", err)
+			}
+			for _, name := range tc.errs {
+				if err == nil || !strings.Contains(err.Error(), name) {
+					t.Errorf("err = %v, want it to mention %q", err, name)
+				}
+			}
+			want := d
+			if tc.want != nil {
+				tc.want(&want)
+			}
+			if !reflect.DeepEqual(s, want) {
+				t.Errorf("settings = %+v\nwant %+v", s, want)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	s, err := Load(filepath.Join(t.TempDir(), "settings.json"))
+	if err != nil {
+		t.Errorf("err = %v, want none", err)
+	}
+	if !reflect.DeepEqual(s, Default()) {
+		t.Errorf("settings = %+v, want the defaults", s)
+	}
+}
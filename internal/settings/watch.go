@@ -0,0 +1,50 @@
+package settings
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Watch polls path every interval and signals on the returned channel when
+// its size or modification time changes, including when it is created or
+// removed. Polling works on every platform and file system. Signals
+// coalesce, and the channel is closed once ctx is done.
+func Watch(ctx context.Context, path string, interval time.Duration) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		last := stamp(path)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			if now := stamp(path); now != last {
+				last = now
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+type fileStamp struct {
+	size int64
+	mod  int64 // UnixNano
+	ok   bool
+}
+
+func stamp(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{size: fi.Size(), mod: fi.ModTime().UnixNano(), ok: true}
+}
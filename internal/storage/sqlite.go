@@ -7,6 +7,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -32,6 +33,19 @@ func NewStorage(path string, cacheTTL time.Duration) (*Storage, error) {
 	return &Storage{db: db, cache: cache.NewTopWinnersCache(cacheTTL)}, nil
 }
 
+// IsLeaderboard reports whether path is a SQLite database holding the
+// winners table this game keeps. The file is opened read-only.
+func IsLeaderboard(path string) bool {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	var n int
+	err = db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'winners'`).Scan(&n)
+	return err == nil && n == 1
+}
+
 func initSchema(db *sql.DB) error {
 	const schema = `
 	CREATE TABLE IF NOT EXISTS winners (
@@ -42,33 +56,77 @@ func initSchema(db *sql.DB) error {
 	);
 	CREATE INDEX IF NOT EXISTS idx_winners_score ON winners(score DESC);
 	`
-	_, err := db.Exec(schema)
-	return err
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	return migrateSchema(db)
+}
+
+// schemaUpgrades are applied in order to bring an older database up to
+// date; PRAGMA user_version records how many have run.
+var schemaUpgrades = []string{
+	// scores recorded before difficulty presets were played on the defaults
+	`ALTER TABLE winners ADD COLUMN difficulty TEXT NOT NULL DEFAULT 'normal';
+	CREATE INDEX IF NOT EXISTS idx_winners_difficulty_score ON winners(difficulty, score DESC);`,
+	// early tables allowed a NULL created_at, which cannot be scanned into
+	// a time (COALESCE in the query would lose the column's TIMESTAMP type,
+	// so every row would come back as text); SaveWinner sets it explicitly
+	// as those tables have no default either
+	`UPDATE winners SET created_at = CURRENT_TIMESTAMP WHERE created_at IS NULL;`,
+}
+
+func migrateSchema(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(schemaUpgrades); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(schemaUpgrades[version]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("upgrading leaderboard schema to %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (s *Storage) SaveWinner(name string, score int) error {
+// SaveWinner records a score played on the given difficulty preset.
+func (s *Storage) SaveWinner(name string, score int, difficulty string) error {
 	if name == "" {
 		return errors.New("name required")
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	_, err := s.db.ExecContext(ctx, "INSERT INTO winners(name, score) VALUES(?, ?)", name, score)
+	_, err := s.db.ExecContext(ctx, "INSERT INTO winners(name, score, difficulty, created_at) VALUES(?, ?, ?, CURRENT_TIMESTAMP)", name, score, difficulty)
 	if err == nil {
 		s.cache.InvalidateAll()
 	}
 	return err
 }
 
-func (s *Storage) TopWinners(limit int) ([]model.Winner, error) {
+// TopWinners returns the best scores on a difficulty, or on all of them if
+// difficulty is empty.
+func (s *Storage) TopWinners(limit int, difficulty string) ([]model.Winner, error) {
 	if limit <= 0 {
 		limit = 10
 	}
-	if winners, ok := s.cache.Get(limit); ok {
+	key := cache.Key{Limit: limit, Difficulty: difficulty}
+	if winners, ok := s.cache.Get(key); ok {
 		return winners, nil
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	rows, err := s.db.QueryContext(ctx, "SELECT id, name, score, COALESCE(created_at, CURRENT_TIMESTAMP) FROM winners ORDER BY score DESC, id ASC LIMIT ?", limit)
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, score, difficulty, created_at FROM winners WHERE ? = '' OR difficulty = ? ORDER BY score DESC, id ASC LIMIT ?", difficulty, difficulty, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -77,7 +135,7 @@ func (s *Storage) TopWinners(limit int) ([]model.Winner, error) {
 	for rows.Next() {
 		var w model.Winner
 		var ts time.Time
-		if err := rows.Scan(&w.ID, &w.Name, &w.Score, &ts); err != nil {
+		if err := rows.Scan(&w.ID, &w.Name, &w.Score, &w.Difficulty, &ts); err != nil {
 			return nil, err
 		}
 		w.CreatedAt = ts
@@ -86,7 +144,7 @@ func (s *Storage) TopWinners(limit int) ([]model.Winner, error) {
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	s.cache.Set(limit, out)
+	s.cache.Set(key, out)
 	return out, nil
 }
 
@@ -0,0 +1,92 @@
+//go:build !js
+// +build !js
+
+package storage
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsLeaderboard(t *testing.T) {
+	dir := t.TempDir()
+	board := filepath.Join(dir, "dimalimbo.db")
+	s, err := NewStorage(board, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	other := filepath.Join(dir, "other.db")
+	db, err := sql.Open("sqlite", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE notes (body TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	text := filepath.Join(dir, "text.db")
+	if err := os.WriteFile(text, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := filepath.Join(dir, "missing.db")
+	for path, want := range map[string]bool{board: true, other: false, text: false, missing: false} {
+		if got := IsLeaderboard(path); got != want {
+			t.Errorf("IsLeaderboard(%s) = %v, want %v", filepath.Base(path), got, want)
+		}
+	}
+	if _, err := os.Stat(missing); err == nil {
+		t.Error("checking a missing file created it")
+	}
+}
+
+// TestTopWinnersLegacyRows reads a leaderboard written by an early build,
+// whose winners table allowed a NULL created_at.
+func TestTopWinnersLegacyRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dimalimbo.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE winners (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		score INTEGER NOT NULL,
+		created_at TIMESTAMP
+	);
+	INSERT INTO winners(name, score, created_at) VALUES('old', 50, NULL), ('dated', 40, '2024-05-01 12:00:00');`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	s, err := NewStorage(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.SaveWinner("new", 60, "hard"); err != nil {
+		t.Fatal(err)
+	}
+	winners, err := s.TopWinners(10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(winners) != 3 || winners[0].Name != "new" || winners[1].Name != "old" || winners[2].Name != "dated" {
+		t.Fatalf("winners = %+v", winners)
+	}
+	if winners[1].CreatedAt.IsZero() || winners[1].Difficulty != "normal" {
+		t.Errorf("legacy row = %+v, want a time and the normal difficulty", winners[1])
+	}
+	if want := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC); !winners[2].CreatedAt.Equal(want) {
+		t.Errorf("created at %v, want %v", winners[2].CreatedAt, want)
+	}
+	if normal, err := s.TopWinners(10, "normal"); err != nil || len(normal) != 2 {
+		t.Errorf("normal = %+v, %v, want the two legacy rows", normal, err)
+	}
+}
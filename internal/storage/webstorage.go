@@ -20,11 +20,15 @@ func NewStorage(_ string, cacheTTL time.Duration) (*Storage, error) {
 	return &Storage{cache: cache.NewTopWinnersCache(cacheTTL)}, nil
 }
 
+// IsLeaderboard is always false: in the browser the leaderboard lives in
+// localStorage, never in a file.
+func IsLeaderboard(string) bool { return false }
+
 func ls() js.Value { return js.Global().Get("localStorage") }
 
-func (s *Storage) SaveWinner(name string, score int) error {
-	winners, _ := s.TopWinners(1000)
-	w := model.Winner{ID: time.Now().UnixNano(), Name: name, Score: score, CreatedAt: time.Now()}
+func (s *Storage) SaveWinner(name string, score int, difficulty string) error {
+	winners, _ := s.TopWinners(1000, "")
+	w := model.Winner{ID: time.Now().UnixNano(), Name: name, Score: score, CreatedAt: time.Now(), Difficulty: difficulty}
 	winners = append(winners, w)
 	b, _ := json.Marshal(winners)
 	ls().Call("setItem", "dimalimbo_winners", string(b))
@@ -32,17 +36,28 @@ func (s *Storage) SaveWinner(name string, score int) error {
 	return nil
 }
 
-func (s *Storage) TopWinners(limit int) ([]model.Winner, error) {
+func (s *Storage) TopWinners(limit int, difficulty string) ([]model.Winner, error) {
 	if limit <= 0 {
 		limit = 10
 	}
-	if w, ok := s.cache.Get(limit); ok {
+	key := cache.Key{Limit: limit, Difficulty: difficulty}
+	if w, ok := s.cache.Get(key); ok {
 		return w, nil
 	}
 	raw := ls().Call("getItem", "dimalimbo_winners").String()
-	winners := []model.Winner{}
+	all := []model.Winner{}
 	if raw != "" {
-		_ = json.Unmarshal([]byte(raw), &winners)
+		_ = json.Unmarshal([]byte(raw), &all)
+	}
+	winners := all[:0]
+	for _, w := range all {
+		// entries saved before presets existed were played on the defaults
+		if w.Difficulty == "" {
+			w.Difficulty = "normal"
+		}
+		if difficulty == "" || w.Difficulty == difficulty {
+			winners = append(winners, w)
+		}
 	}
 	// sort by score desc
 	for i := 0; i < len(winners); i++ {
@@ -55,7 +70,7 @@ func (s *Storage) TopWinners(limit int) ([]model.Winner, error) {
 	if len(winners) > limit {
 		winners = winners[:limit]
 	}
-	s.cache.Set(limit, winners)
+	s.cache.Set(key, winners)
 	return winners, nil
 }
 